@@ -4,45 +4,43 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/resolver"
 )
 
 const (
 	kubernetesSchema = "kubernetes"
 	defaultFreq      = time.Minute * 30
-)
-
-var (
-	endpointsForTarget = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kuberesolver_endpoints_total",
-			Help: "The number of endpoints for a given target",
-		},
-		[]string{"target"},
-	)
-	addressesForTarget = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kuberesolver_addresses_total",
-			Help: "The number of addresses for a given target",
-		},
-		[]string{"target"},
-	)
-	clientLastUpdate = promauto.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kuberesolver_client_last_update",
-			Help: "The last time the resolver client was updated",
-		},
-		[]string{"target"},
-	)
+	// defaultWatchTimeout is the duration after which the apiserver closes a
+	// watch. The watch is then resumed from the last seen resourceVersion.
+	defaultWatchTimeout = time.Minute * 5
+	// defaultWatchIdleGrace is added to the watch timeout to get the default
+	// watch idle timeout: a healthy watch is ended by the apiserver before.
+	defaultWatchIdleGrace = time.Minute
+	// defaultResolveNowFreq is the minimum interval between two lists
+	// triggered by ResolveNow.
+	defaultResolveNowFreq = time.Second * 5
+	defaultBackoffInitial = time.Second
+	defaultBackoffMax     = time.Second * 30
+	// defaultBackoffHealthy is the duration after which a watch is considered
+	// healthy and the backoff is reset.
+	defaultBackoffHealthy = time.Minute
+	// listTimeout bounds a list of the EndpointSlices, including the read of
+	// the response.
+	listTimeout = time.Minute
+	// maxHistory is the number of address updates kept for introspection.
+	maxHistory = 10
+	// persistentFailures is the number of consecutive watch failures after
+	// which they are reported to the ClientConns of a synced informer.
+	persistentFailures = 3
 )
 
 type targetInfo struct {
@@ -72,17 +70,71 @@ func RegisterInClusterWithSchema(schema string) {
 	resolver.Register(NewBuilder(nil, schema))
 }
 
-// NewBuilder creates a kubeBuilder which is used by grpc resolver.
+// NewBuilder creates a Builder which is used by grpc resolver.
 func NewBuilder(client K8sClient, schema string) resolver.Builder {
-	return &kubeBuilder{
-		k8sClient: client,
-		schema:    schema,
+	return NewBuilderWithOptions(client, schema)
+}
+
+// NewBuilderWithOptions creates a Builder which is used by grpc resolver
+// and configures it with the given options. If client is nil, an in-cluster
+// client is created on the first Build.
+func NewBuilderWithOptions(client K8sClient, schema string, opts ...Option) *Builder {
+	b := &Builder{
+		k8sClient:      client,
+		schema:         schema,
+		resyncPeriod:   defaultFreq,
+		watchTimeout:   defaultWatchTimeout,
+		resolveNowFreq: defaultResolveNowFreq,
+		backoff: backoff{
+			initial: defaultBackoffInitial,
+			max:     defaultBackoffMax,
+			jitter:  1,
+			healthy: defaultBackoffHealthy,
+		},
+		logger:    newGrpclogLogger(),
+		resolvers: map[*kResolver]struct{}{},
+		informers: map[informerKey]*informer{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.metrics == nil {
+		b.metrics = metricsFor(prometheus.DefaultRegisterer)
 	}
+
+	return b
 }
 
-type kubeBuilder struct {
-	k8sClient K8sClient
-	schema    string
+// Builder is a gRPC resolver.Builder resolving kubernetes services to the
+// addresses of their EndpointSlices.
+type Builder struct {
+	k8sClient    K8sClient
+	schema       string
+	resyncPeriod time.Duration
+	watchTimeout time.Duration
+	// watchIdleTimeout is zero to derive it from watchTimeout.
+	watchIdleTimeout time.Duration
+	resolveNowFreq   time.Duration
+	namespaceWatch   bool
+	backoff          backoff
+	// limiter bounds the concurrent list and watch requests of all
+	// resolvers, nil if they are not limited.
+	limiter        chan struct{}
+	logger         *slog.Logger
+	metrics        *metrics
+	recorders      multiRecorder
+	clientWrappers []func(K8sClient) K8sClient
+	filters        []EndpointFilter
+
+	// mu guards k8sClient creation, the registry of active resolvers and
+	// the informers shared by them.
+	mu        sync.Mutex
+	resolvers map[*kResolver]struct{}
+	informers map[informerKey]*informer
+	// ownsClient is set if the builder created k8sClient.
+	ownsClient bool
+	closed     bool
 }
 
 func splitServicePortNamespace(hpn string) (service, port, namespace string) {
@@ -146,14 +198,23 @@ func parseResolverTarget(target resolver.Target) (targetInfo, error) {
 //
 // gRPC dial calls Build synchronously, and fails if the returned error is
 // not nil.
-func (b *kubeBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, errBuilderClosed
+	}
+
 	if b.k8sClient == nil {
 		if cl, err := NewInClusterK8sClient(); err == nil {
 			b.k8sClient = cl
+			b.ownsClient = true
 		} else {
+			b.mu.Unlock()
 			return nil, err
 		}
 	}
+	b.mu.Unlock()
 
 	ti, err := parseResolverTarget(target)
 	if err != nil {
@@ -161,52 +222,192 @@ func (b *kubeBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts
 	}
 
 	if ti.serviceNamespace == "" {
-		ti.serviceNamespace = getCurrentNamespaceOrDefault()
+		ti.serviceNamespace = b.defaultNamespace()
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// acquire before the series are created so that a concurrent Close of
+	// another resolver of the target does not delete them
+	b.metrics.acquire(ti.String())
+	b.recorders.TargetOpened(ti.String())
+
 	r := &kResolver{
-		target:    ti,
-		ctx:       ctx,
-		cancel:    cancel,
-		cc:        cc,
-		k8sClient: b.k8sClient,
-		t:         time.NewTimer(defaultFreq),
-		freq:      defaultFreq,
-
-		endpoints:      endpointsForTarget.WithLabelValues(ti.String()),
-		addresses:      addressesForTarget.WithLabelValues(ti.String()),
-		lastUpdateUnix: clientLastUpdate.WithLabelValues(ti.String()),
-	}
-	r.wg.Add(1)
-
-	go until(func() {
-		err := r.watch()
-		if err != nil && err != io.EOF {
-			grpclog.Errorf("kuberesolver: watching ended with error='%v', will reconnect again", err)
-		}
-	}, time.Second, time.Second*30, ctx.Done())
+		target:  ti,
+		cc:      cc,
+		filters: b.filters,
+		logger: b.logger.With(
+			slog.String("target", ti.String()),
+			slog.String("namespace", ti.serviceNamespace),
+			slog.String("service", ti.serviceName),
+		),
+		builder: b,
+
+		metrics:        b.metrics,
+		recorder:       b.recorders,
+		endpoints:      b.metrics.endpointsForTarget.WithLabelValues(ti.String()),
+		addresses:      b.metrics.addressesForTarget.WithLabelValues(ti.String()),
+		lastUpdateUnix: b.metrics.clientLastUpdate.WithLabelValues(ti.String()),
+	}
+
+	state, synced, err := b.subscribe(r)
+	if err != nil {
+		b.metrics.release(ti.String())
+		b.recorders.TargetClosed(ti.String())
+
+		return nil, err
+	}
+
+	if synced {
+		// the service is already watched for another ClientConn, hand its
+		// current state to the new one outside of Build
+		go r.apply(state)
+	}
 
 	return r, nil
 }
 
+// idleTimeout returns the watch idle timeout, zero if it is disabled.
+func (b *Builder) idleTimeout() time.Duration {
+	switch {
+	case b.watchIdleTimeout < 0:
+		return 0
+	case b.watchIdleTimeout > 0:
+		return b.watchIdleTimeout
+	case b.watchTimeout > 0:
+		return b.watchTimeout + defaultWatchIdleGrace
+	default:
+		return 0
+	}
+}
+
+// defaultNamespace returns the namespace of targets without one, which is the
+// namespace of the kubeconfig context or else of the pod.
+func (b *Builder) defaultNamespace() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if kc, ok := b.k8sClient.(*k8sClient); ok && kc.namespace != "" {
+		return kc.namespace
+	}
+
+	return getCurrentNamespaceOrDefault()
+}
+
+// subscribe registers r and subscribes it to the informer of its service, or
+// of its namespace in namespace watch mode, starting the informer if r is its
+// first subscriber.
+func (b *Builder) subscribe(r *kResolver) (sliceState, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return sliceState{}, false, errBuilderClosed
+	}
+
+	key := informerKey{namespace: r.target.serviceNamespace, service: r.target.serviceName}
+	if b.namespaceWatch {
+		key.service = ""
+	}
+
+	inf, ok := b.informers[key]
+	if !ok {
+		client := b.k8sClient
+		for _, wrap := range b.clientWrappers {
+			client = wrap(client)
+		}
+
+		inf = newInformer(b, client, key)
+		b.informers[key] = inf
+	}
+
+	r.informer = inf
+	b.resolvers[r] = struct{}{}
+	state, synced := inf.subscribe(r)
+
+	if !ok {
+		inf.start(b.backoff)
+	}
+
+	return state, synced, nil
+}
+
+// unsubscribe unregisters r and stops the informer of its service if r was
+// its last subscriber.
+func (b *Builder) unsubscribe(r *kResolver) {
+	b.mu.Lock()
+
+	delete(b.resolvers, r)
+
+	inf := r.informer
+	if inf.unsubscribe(r) > 0 {
+		b.mu.Unlock()
+		return
+	}
+
+	// the informer is already removed if the builder was closed
+	if b.informers[inf.key] == inf {
+		delete(b.informers, inf.key)
+	}
+	b.mu.Unlock()
+
+	inf.stop()
+}
+
+// Close stops the watches of all resolvers of the builder, which receive no
+// update anymore, and closes the in-cluster client if the builder created
+// it. A client given to NewBuilderWithOptions is owned by the caller and
+// left open. Build fails once the builder is closed.
+func (b *Builder) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	informers := b.informers
+	b.informers = map[informerKey]*informer{}
+	closer, ok := b.k8sClient.(io.Closer)
+	ok = ok && b.ownsClient
+	b.mu.Unlock()
+
+	for _, inf := range informers {
+		inf.stop()
+	}
+
+	if ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
 // Scheme returns the scheme supported by this resolver.
 // Scheme is defined at https://github.com/grpc/grpc/blob/master/doc/naming.md.
-func (b *kubeBuilder) Scheme() string {
+func (b *Builder) Scheme() string {
 	return b.schema
 }
 
+// kResolver hands the addresses of the EndpointSlices received from the
+// informer of its service to a ClientConn.
 type kResolver struct {
-	target    targetInfo
-	ctx       context.Context
-	cancel    context.CancelFunc
-	cc        resolver.ClientConn
-	k8sClient K8sClient
-	// wg is used to enforce Close() to return after the watcher() goroutine has finished.
-	wg   sync.WaitGroup
-	t    *time.Timer
-	freq time.Duration
-
+	target   targetInfo
+	cc       resolver.ClientConn
+	filters  []EndpointFilter
+	logger   *slog.Logger
+	builder  *Builder
+	informer *informer
+
+	// mu guards the state below and serializes the updates of cc.
+	mu sync.Mutex
+	// generation is the generation of the last applied sliceState.
+	generation uint64
+	closed     bool
+	published  []resolver.Address
+	lastUpdate time.Time
+	history    []UpdateRecord
+
+	metrics   *metrics
+	recorder  multiRecorder
 	endpoints prometheus.Gauge
 	addresses prometheus.Gauge
 	// lastUpdateUnix is the timestamp of the last successful update to the resolver client
@@ -216,13 +417,36 @@ type kResolver struct {
 // ResolveNow will be called by gRPC to try to resolve the target name again.
 // It's just a hint, resolver can ignore this if it's not necessary.
 func (k *kResolver) ResolveNow(resolver.ResolveNowOptions) {
-	// ignore
+	k.informer.requestResolve()
 }
 
 // Close closes the resolver.
 func (k *kResolver) Close() {
-	k.cancel()
-	k.wg.Wait()
+	k.mu.Lock()
+	k.closed = true
+	k.mu.Unlock()
+
+	k.builder.unsubscribe(k)
+	k.metrics.release(k.target.String())
+	k.recorder.TargetClosed(k.target.String())
+}
+
+// reportError reports to the ClientConn that the endpoints of the target can
+// not be resolved, so that RPCs not waiting for ready fail with err.
+func (k *kResolver) reportError(err error, failures int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.closed {
+		return
+	}
+
+	k.cc.ReportError(&SyncError{
+		Namespace: k.target.serviceNamespace,
+		Service:   k.target.serviceName,
+		Failures:  failures,
+		Err:       err,
+	})
 }
 
 func (k *kResolver) makeAddresses(e EndpointSlice) ([]resolver.Address, string) {
@@ -238,6 +462,11 @@ func (k *kResolver) makeAddresses(e EndpointSlice) ([]resolver.Address, string)
 	}
 
 	if len(port) == 0 {
+		if len(e.Ports) == 0 {
+			// a slice without ports has nothing to route to
+			return nil, ""
+		}
+
 		port = strconv.Itoa(e.Ports[0].Port)
 	}
 
@@ -248,6 +477,10 @@ func (k *kResolver) makeAddresses(e EndpointSlice) ([]resolver.Address, string)
 			continue
 		}
 
+		if !k.accept(endpoint) {
+			continue
+		}
+
 		for _, address := range endpoint.Addresses {
 			newAddrs = append(newAddrs, resolver.Address{
 				Addr:       net.JoinHostPort(address, port),
@@ -260,52 +493,119 @@ func (k *kResolver) makeAddresses(e EndpointSlice) ([]resolver.Address, string)
 	return newAddrs, ""
 }
 
-func (k *kResolver) handle(e EndpointSlice) {
-	addrs, _ := k.makeAddresses(e)
-	if len(addrs) > 0 {
+// accept reports whether all filters accept the endpoint.
+func (k *kResolver) accept(e Endpoint) bool {
+	for _, f := range k.filters {
+		if !f(e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply publishes the union of the addresses of every EndpointSlice of the
+// state to the ClientConn. States older than the last applied one and states
+// received after Close are ignored.
+func (k *kResolver) apply(state sliceState) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.closed || (k.generation != 0 && state.generation <= k.generation) {
+		return
+	}
+
+	k.generation = state.generation
+
+	names := make([]string, 0, len(state.slices))
+	for name := range state.slices {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var (
+		addrs     []resolver.Address
+		endpoints int
+	)
+
+	seen := map[string]struct{}{}
+
+	for _, name := range names {
+		e := state.slices[name]
+		endpoints += len(e.Endpoints)
+
+		sliceAddrs, _ := k.makeAddresses(e)
+		for _, a := range sliceAddrs {
+			// an endpoint may briefly appear in two slices while it is
+			// moved between them
+			if _, ok := seen[a.Addr]; ok {
+				continue
+			}
+
+			seen[a.Addr] = struct{}{}
+			addrs = append(addrs, a)
+		}
+	}
+
+	switch {
+	case len(addrs) > 0 || k.published != nil:
+		// an empty union is handed over as well once addresses were
+		// published, e.g. when the last slice is deleted or every endpoint
+		// became unready, so that the ClientConn drops the stale ones
+		k.published = addrs
+		k.lastUpdate = time.Now()
+		k.recordHistory(state.resourceVersion)
+
 		_ = k.cc.UpdateState(resolver.State{
 			Addresses: addrs,
 		})
 		k.lastUpdateUnix.Set(float64(time.Now().Unix()))
+		k.recorder.ObserveUpdate(k.target.String())
+	default:
+		// nothing was handed to the ClientConn yet, e.g. the service does not
+		// exist, tell it why instead of leaving it connecting
+		k.cc.ReportError(&SyncError{
+			Namespace: k.target.serviceNamespace,
+			Service:   k.target.serviceName,
+			Err:       ErrNoEndpoints,
+		})
 	}
 
-	k.endpoints.Set(float64(len(e.Endpoints)))
+	k.endpoints.Set(float64(endpoints))
 	k.addresses.Set(float64(len(addrs)))
-}
+	k.recorder.ObserveEndpoints(k.target.String(), endpoints, len(addrs))
 
-func (k *kResolver) resolve() {
-	list, err := getEndpointSliceList(k.k8sClient, k.target.serviceNamespace, k.target.serviceName)
-	if err == nil {
-		for _, e := range list.Items {
-			k.handle(e)
+	if k.logger.Enabled(context.Background(), slog.LevelDebug) {
+		list := make([]string, len(addrs))
+		for i, a := range addrs {
+			list[i] = a.Addr
 		}
-	} else {
-		grpclog.Errorf("kuberesolver: lookup endpoints failed: %v", err)
+
+		k.logger.Debug("updated addresses",
+			slog.Any("addresses", list),
+			slog.Int("endpoints", endpoints),
+			slog.Int("slices", len(state.slices)),
+			slog.String("resourceVersion", state.resourceVersion),
+		)
 	}
-	// Next lookup should happen after an interval defined by k.freq.
-	k.t.Reset(k.freq)
 }
 
-func (k *kResolver) watch() error {
-	defer k.wg.Done()
-	// watch endpoints lists existing endpoints at start
-	sw, err := watchEndpointSlice(k.ctx, k.k8sClient, k.target.serviceNamespace, k.target.serviceName)
-	if err != nil {
-		return err
-	}
-
-	for {
-		select {
-		case <-k.ctx.Done():
-			return nil
-		case <-k.t.C:
-			k.resolve()
-		case up, hasMore := <-sw.ResultChan():
-			if hasMore {
-				k.handle(up.Object)
-			} else {
-				return nil
-			}
-		}
+// recordHistory appends the published addresses to the update history,
+// k.mu must be held.
+func (k *kResolver) recordHistory(resourceVersion string) {
+	rec := UpdateRecord{
+		Time:            k.lastUpdate,
+		ResourceVersion: resourceVersion,
+		Addresses:       make([]string, len(k.published)),
+	}
+	for i, a := range k.published {
+		rec.Addresses[i] = a.Addr
 	}
+
+	if len(k.history) >= maxHistory {
+		k.history = append(k.history[:0], k.history[1:]...)
+	}
+
+	k.history = append(k.history, rec)
 }
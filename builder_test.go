@@ -1,19 +1,26 @@
 package kuberesolver
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
 )
@@ -31,9 +38,99 @@ func isKubeProxyAvailable() bool {
 	return true
 }
 
-// newMockKubeServer starts a httptest.Server that returns fake EndpointSlice
-// responses for both the watch and list API paths.
-func newMockKubeServer(t *testing.T) *httptest.Server {
+// mockKubeServer is a fake apiserver serving EndpointSlice lists and
+// watches. It records the requests it received.
+type mockKubeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []url.URL
+	received []time.Time
+
+	// lists counts the list requests, watches the watches that were opened
+	// and openWatches the ones that are still open.
+	lists       atomic.Int32
+	watches     atomic.Int32
+	openWatches atomic.Int32
+	// inflightLists counts the lists being served, maxInflightLists is the
+	// highest number of lists served at once.
+	inflightLists    atomic.Int32
+	maxInflightLists atomic.Int32
+}
+
+type mockConfig struct {
+	resourceVersion string
+	items           []EndpointSlice
+	// initial are the events sent when a watch is opened.
+	initial []Event
+	// events are streamed to the open watch, a zero Event ends it.
+	events      <-chan Event
+	listStatus  int
+	watchStatus int
+	// resyncStatus is the status code of the lists following the first
+	// one, zero to answer them like the first.
+	resyncStatus int
+	listDelay    time.Duration
+	// watchHang makes watches wait for the client to give up without
+	// answering.
+	watchHang bool
+}
+
+type mockOption func(*mockConfig)
+
+// withMockList sets the resourceVersion and items of the lists. Watches
+// start without events.
+func withMockList(resourceVersion string, items ...EndpointSlice) mockOption {
+	return func(c *mockConfig) {
+		c.resourceVersion = resourceVersion
+		c.items = items
+		c.initial = nil
+	}
+}
+
+// withMockStatus makes lists and watches fail with the given status codes,
+// http.StatusOK to succeed.
+func withMockStatus(list, watch int) mockOption {
+	return func(c *mockConfig) {
+		c.listStatus = list
+		c.watchStatus = watch
+	}
+}
+
+// withMockEvents streams the events received from events to the watches.
+func withMockEvents(events <-chan Event) mockOption {
+	return func(c *mockConfig) {
+		c.events = events
+	}
+}
+
+// withMockListDelay delays the answer to every list.
+// withMockResyncStatus makes the lists following the first one fail with the
+// given status code.
+func withMockResyncStatus(code int) mockOption {
+	return func(c *mockConfig) {
+		c.resyncStatus = code
+	}
+}
+
+func withMockListDelay(d time.Duration) mockOption {
+	return func(c *mockConfig) {
+		c.listDelay = d
+	}
+}
+
+// withMockWatchHang makes watches never answer.
+func withMockWatchHang() mockOption {
+	return func(c *mockConfig) {
+		c.watchHang = true
+	}
+}
+
+// newMockKubeServer starts a fake apiserver. By default lists return a single
+// slice with two addresses on the port named dns, and watches send it as an
+// ADDED event before holding the connection open until the client
+// disconnects.
+func newMockKubeServer(t *testing.T, opts ...mockOption) *mockKubeServer {
 	t.Helper()
 
 	ready := true
@@ -51,37 +148,168 @@ func newMockKubeServer(t *testing.T) *httptest.Server {
 		},
 	}
 
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.URL.Path, "/watch/") {
-			// Watch endpoint: stream a single ADDED event, then hold the
-			// connection open until the client disconnects.
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
+	c := &mockConfig{
+		items:       []EndpointSlice{fakeSlice},
+		initial:     []Event{{Type: Added, Object: fakeSlice}},
+		listStatus:  http.StatusOK,
+		watchStatus: http.StatusOK,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
 
-			event := Event{
-				Type:   Added,
-				Object: fakeSlice,
-			}
-			if err := json.NewEncoder(w).Encode(event); err != nil {
+	m := &mockKubeServer{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.requests = append(m.requests, *r.URL)
+		m.received = append(m.received, time.Now())
+		m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !strings.Contains(r.URL.Path, "/watch/") {
+			m.serveList(w, c)
+			return
+		}
+
+		if c.watchHang {
+			m.openWatches.Add(1)
+			defer m.openWatches.Add(-1)
+
+			<-r.Context().Done()
+
+			return
+		}
+
+		if c.watchStatus != http.StatusOK {
+			writeMockStatus(w, c.watchStatus)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		for _, ev := range c.initial {
+			if err := json.NewEncoder(w).Encode(ev); err != nil {
 				t.Logf("mock server: failed to encode watch event: %v", err)
 				return
 			}
+		}
 
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-			// Block until the client closes the connection.
-			<-r.Context().Done()
-		} else {
-			// List endpoint
-			w.Header().Set("Content-Type", "application/json")
+		w.(http.Flusher).Flush()
+
+		m.watches.Add(1)
+		m.openWatches.Add(1)
+		defer m.openWatches.Add(-1)
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-c.events:
+				if ev.Type == "" {
+					return
+				}
 
-			list := EndpointSliceList{
-				Items: []EndpointSlice{fakeSlice},
+				encodeMockEvent(w, ev)
+				w.(http.Flusher).Flush()
 			}
-			_ = json.NewEncoder(w).Encode(list)
 		}
 	}))
+
+	return m
+}
+
+func (m *mockKubeServer) serveList(w http.ResponseWriter, c *mockConfig) {
+	lists := m.lists.Add(1)
+
+	n := m.inflightLists.Add(1)
+	defer m.inflightLists.Add(-1)
+
+	for {
+		highest := m.maxInflightLists.Load()
+		if n <= highest || m.maxInflightLists.CompareAndSwap(highest, n) {
+			break
+		}
+	}
+
+	time.Sleep(c.listDelay)
+
+	if c.listStatus != http.StatusOK {
+		writeMockStatus(w, c.listStatus)
+		return
+	}
+
+	if c.resyncStatus != 0 && lists > 1 {
+		writeMockStatus(w, c.resyncStatus)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(EndpointSliceList{
+		Metadata: ListMetadata{ResourceVersion: c.resourceVersion},
+		Items:    c.items,
+	})
+}
+
+// encodeMockEvent writes ev to a watch stream, with its Status as object for
+// ERROR events.
+func encodeMockEvent(w io.Writer, ev Event) {
+	if ev.Status == nil {
+		_ = json.NewEncoder(w).Encode(ev)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Type   EventType `json:"type"`
+		Object *Status   `json:"object"`
+	}{Type: ev.Type, Object: ev.Status})
+}
+
+func writeMockStatus(w http.ResponseWriter, code int) {
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(Status{
+		Status: "Failure",
+		Reason: reasonForCode(code),
+		Code:   code,
+	})
+}
+
+// queries returns the query of every request received, lists and watches
+// alike.
+func (m *mockKubeServer) queries() []url.Values {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queries := make([]url.Values, len(m.requests))
+	for i, u := range m.requests {
+		queries[i] = u.Query()
+	}
+
+	return queries
+}
+
+// times returns when each request was received.
+func (m *mockKubeServer) times() []time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]time.Time(nil), m.received...)
+}
+
+// calls returns the requests received as "list" or "watch <resourceVersion>".
+func (m *mockKubeServer) calls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	calls := make([]string, len(m.requests))
+	for i, u := range m.requests {
+		if strings.Contains(u.Path, "/watch/") {
+			calls[i] = "watch " + u.Query().Get("resourceVersion")
+		} else {
+			calls[i] = "list"
+		}
+	}
+
+	return calls
 }
 
 // getTestAPIURL returns the base URL to use for integration tests together
@@ -102,24 +330,53 @@ func getTestAPIURL(t *testing.T) (apiURL string, cleanup func()) {
 }
 
 type fakeConn struct {
-	cmp   chan struct{}
-	found []string
+	cmp     chan struct{}
+	mu      sync.Mutex
+	found   []string
+	updates int
+	errors  []error
 }
 
 func (fc *fakeConn) UpdateState(state resolver.State) error {
+	fc.mu.Lock()
+	fc.updates++
+
 	for i, a := range state.Addresses {
 		fc.found = append(fc.found, a.Addr)
 		fmt.Printf("%d, address: %s\n", i, a.Addr)
 		fmt.Printf("%d, servername: %s\n", i, a.ServerName)
 	}
+	fc.mu.Unlock()
 
-	fc.cmp <- struct{}{}
+	// notify the test without blocking the resolver on later updates
+	select {
+	case fc.cmp <- struct{}{}:
+	default:
+	}
 
 	return nil
 }
 
+func (fc *fakeConn) addresses() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return append([]string(nil), fc.found...)
+}
+
 func (fc *fakeConn) ReportError(e error) {
 	log.Println(e)
+
+	fc.mu.Lock()
+	fc.errors = append(fc.errors, e)
+	fc.mu.Unlock()
+}
+
+func (fc *fakeConn) reportedErrors() []error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	return append([]error(nil), fc.errors...)
 }
 
 func (fc *fakeConn) ParseServiceConfig(_ string) *serviceconfig.ParseResult {
@@ -144,7 +401,7 @@ func TestBuilder(t *testing.T) {
 	cl := NewInsecureK8sClient(apiURL)
 	bl := NewBuilder(cl, kubernetesSchema)
 	fc := &fakeConn{
-		cmp: make(chan struct{}),
+		cmp: make(chan struct{}, 1),
 	}
 
 	rs, err := bl.Build(parseTarget("kubernetes://kube-dns.kube-system:53"), fc, resolver.BuildOptions{})
@@ -155,7 +412,7 @@ func TestBuilder(t *testing.T) {
 
 	<-fc.cmp
 
-	if len(fc.found) == 0 {
+	if len(fc.addresses()) == 0 {
 		t.Fatal("could not found endpoints")
 	}
 }
@@ -167,7 +424,7 @@ func TestResolveLag(t *testing.T) {
 	cl := NewInsecureK8sClient(apiURL)
 	bl := NewBuilder(cl, kubernetesSchema)
 	fc := &fakeConn{
-		cmp: make(chan struct{}),
+		cmp: make(chan struct{}, 1),
 	}
 
 	rs, err := bl.Build(parseTarget("kubernetes://kube-dns.kube-system:53"), fc, resolver.BuildOptions{})
@@ -178,7 +435,7 @@ func TestResolveLag(t *testing.T) {
 
 	<-fc.cmp
 
-	if len(fc.found) == 0 {
+	if len(fc.addresses()) == 0 {
 		t.Fatal("could not found endpoints")
 	}
 
@@ -190,6 +447,870 @@ func TestResolveLag(t *testing.T) {
 	t.Logf("client resolver lag: %v s", -clientResolveLag)
 }
 
+func newTestSlice(name string, port int, addrs ...string) EndpointSlice {
+	ready := true
+
+	return EndpointSlice{
+		Metadata: Metadata{Name: name},
+		Endpoints: []Endpoint{
+			{
+				Addresses:  addrs,
+				Conditions: EndpointConditions{Ready: &ready},
+			},
+		},
+		Ports: []EndpointPort{
+			{Name: "grpc", Port: port},
+		},
+	}
+}
+
+// newTestResolver returns a resolver subscribed to an informer that is not
+// started, so that tests can feed it slices directly.
+func newTestResolver(t *testing.T, target string, fc *fakeConn) (*kResolver, *informer) {
+	t.Helper()
+
+	ti, err := parseResolverTarget(parseTarget(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuilderWithOptions(nil, kubernetesSchema, WithRegisterer(prometheus.NewRegistry()))
+	inf := newInformer(b, nil, informerKey{namespace: ti.serviceNamespace, service: ti.serviceName})
+
+	r := &kResolver{
+		target:         ti,
+		cc:             fc,
+		logger:         newGrpclogLogger(),
+		informer:       inf,
+		metrics:        b.metrics,
+		endpoints:      b.metrics.endpointsForTarget.WithLabelValues(ti.String()),
+		addresses:      b.metrics.addressesForTarget.WithLabelValues(ti.String()),
+		lastUpdateUnix: b.metrics.clientLastUpdate.WithLabelValues(ti.String()),
+	}
+	inf.subscribe(r)
+
+	return r, inf
+}
+
+func TestHandleAggregatesSlices(t *testing.T) {
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 3),
+	}
+	r, inf := newTestResolver(t, "kubernetes:///svc.ns:grpc", fc)
+
+	inf.handle(newTestSlice("svc-a", 8080, "10.0.0.1", "10.0.0.2"))
+	inf.handle(newTestSlice("svc-b", 8080, "10.0.0.3", "10.0.0.1"))
+
+	fc.found = nil
+	// a modification of one slice must not drop the addresses of the other
+	inf.handle(newTestSlice("svc-a", 8080, "10.0.0.4"))
+
+	assert.Equal(t, []string{"10.0.0.4:8080", "10.0.0.3:8080", "10.0.0.1:8080"}, fc.found)
+	assert.Equal(t, 3.0, testutil.ToFloat64(r.addresses))
+}
+
+func TestRemoveDeletedSlice(t *testing.T) {
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 3),
+	}
+	r, inf := newTestResolver(t, "kubernetes:///svc.ns:grpc", fc)
+
+	inf.handle(newTestSlice("svc-a", 8080, "10.0.0.1"))
+	inf.handle(newTestSlice("svc-b", 8080, "10.0.0.2"))
+
+	fc.found = nil
+	inf.remove(EndpointSlice{Metadata: Metadata{Name: "svc-a"}})
+
+	assert.Equal(t, []string{"10.0.0.2:8080"}, fc.found)
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.addresses))
+}
+
+func TestRemoveLastSlice(t *testing.T) {
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 3),
+	}
+	r, inf := newTestResolver(t, "kubernetes:///svc.ns:grpc", fc)
+
+	inf.handle(newTestSlice("svc-a", 8080, "10.0.0.1"))
+	assert.Equal(t, 1, fc.updates)
+
+	// the ClientConn must drop the address of the deleted slice
+	fc.found = nil
+	inf.remove(EndpointSlice{Metadata: Metadata{Name: "svc-a"}})
+
+	assert.Equal(t, 2, fc.updates)
+	assert.Empty(t, fc.found)
+	assert.Empty(t, r.published)
+	assert.Equal(t, 0.0, testutil.ToFloat64(r.addresses))
+}
+
+func TestSharedWatchPerService(t *testing.T) {
+	srv := newMockKubeServer(t, withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")))
+	defer srv.Close()
+
+	b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()))
+
+	conns := make([]*fakeConn, 3)
+	resolvers := make([]resolver.Resolver, 3)
+
+	for i := range conns {
+		conns[i] = &fakeConn{cmp: make(chan struct{}, 1)}
+
+		rs, err := b.Build(parseTarget("kubernetes:///svc.ns:8080"), conns[i], resolver.BuildOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resolvers[i] = rs
+	}
+
+	for _, fc := range conns {
+		<-fc.cmp
+		assert.Equal(t, []string{"10.0.0.1:8080"}, fc.addresses())
+	}
+
+	assert.Len(t, b.informers, 1)
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	for _, rs := range resolvers[1:] {
+		rs.Close()
+	}
+
+	assert.Len(t, b.informers, 1)
+
+	// the informer is stopped with its last resolver
+	resolvers[0].Close()
+	assert.Empty(t, b.informers)
+	assert.Equal(t, int32(1), srv.watches.Load())
+}
+
+func TestBuilderClose(t *testing.T) {
+	srv := newMockKubeServer(t, withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")))
+	defer srv.Close()
+
+	b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()))
+	fc := &fakeConn{cmp: make(chan struct{}, 1)}
+
+	rs, err := b.Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-fc.cmp
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// the watch ends with the builder
+	assert.NoError(t, b.Close())
+
+	assert.Eventually(t, func() bool { return srv.openWatches.Load() == 0 }, 5*time.Second, 10*time.Millisecond,
+		"watch was not stopped by Close")
+
+	_, err = b.Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	assert.ErrorIs(t, err, errBuilderClosed)
+
+	// resolvers can still be closed by gRPC afterwards
+	rs.Close()
+	assert.NoError(t, b.Close())
+}
+
+func TestNamespaceWatch(t *testing.T) {
+	withService := func(e EndpointSlice, service string) EndpointSlice {
+		e.Metadata.Labels = map[string]string{serviceNameLabel: service}
+		return e
+	}
+
+	events := make(chan Event)
+	srv := newMockKubeServer(t,
+		withMockList("1",
+			withService(newTestSlice("foo-a", 8080, "10.0.0.1"), "foo"),
+			withService(newTestSlice("bar-a", 8080, "10.0.1.1"), "bar"),
+		),
+		withMockEvents(events))
+	defer srv.Close()
+
+	b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()), WithNamespaceWatch())
+
+	foo := &fakeConn{cmp: make(chan struct{}, 2)}
+	bar := &fakeConn{cmp: make(chan struct{}, 2)}
+
+	rsFoo, err := b.Build(parseTarget("kubernetes:///foo.ns:8080"), foo, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsFoo.Close()
+
+	<-foo.cmp
+	assert.Equal(t, []string{"10.0.0.1:8080"}, foo.addresses())
+
+	rsBar, err := b.Build(parseTarget("kubernetes:///bar.ns:8080"), bar, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsBar.Close()
+
+	<-bar.cmp
+	assert.Equal(t, []string{"10.0.1.1:8080"}, bar.addresses())
+
+	// one list and one watch for the namespace
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	for _, query := range srv.queries() {
+		assert.Equal(t, serviceNameLabel, query.Get("labelSelector"))
+	}
+
+	assert.Equal(t, []string{"list", "watch 1"}, srv.calls())
+	assert.Len(t, b.informers, 1)
+
+	// an event is dispatched to the resolvers of its service only
+	bar.mu.Lock()
+	bar.found = nil
+	bar.mu.Unlock()
+
+	events <- Event{Type: Modified, Object: withService(newTestSlice("bar-a", 8080, "10.0.1.2"), "bar")}
+
+	<-bar.cmp
+	assert.Equal(t, []string{"10.0.1.2:8080"}, bar.addresses())
+	assert.Empty(t, foo.cmp)
+	assert.Len(t, srv.calls(), 2)
+}
+
+func TestWatchResumesFromListResourceVersion(t *testing.T) {
+	srv := newMockKubeServer(t, withMockList("42", newTestSlice("svc-a", 8080, "10.0.0.1")))
+	defer srv.Close()
+
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	rs, err := NewBuilder(NewInsecureK8sClient(srv.URL), kubernetesSchema).
+		Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	<-fc.cmp
+	assert.Equal(t, []string{"10.0.0.1:8080"}, fc.addresses())
+
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	query := srv.queries()[1]
+	assert.Equal(t, "42", query.Get("resourceVersion"))
+	assert.Equal(t, "true", query.Get("allowWatchBookmarks"))
+	assert.Equal(t, "300", query.Get("timeoutSeconds"))
+}
+
+func TestWatchTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{timeout: 90 * time.Second, want: "90"},
+		// the apiserver picks the timeout
+		{timeout: 0, want: ""},
+	} {
+		srv := newMockKubeServer(t, withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")))
+
+		rs, err := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+			WithRegisterer(prometheus.NewRegistry()),
+			WithWatchTimeout(tt.timeout)).
+			Build(parseTarget("kubernetes:///svc.ns:8080"), &fakeConn{cmp: make(chan struct{}, 1)}, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, tt.want, srv.queries()[1].Get("timeoutSeconds"))
+
+		rs.Close()
+		srv.Close()
+	}
+}
+
+func TestWatchResumesAfterDisconnectAndRelistsWhenExpired(t *testing.T) {
+	modified := newTestSlice("svc-a", 8080, "10.0.0.2")
+	modified.Metadata.ResourceVersion = "7"
+
+	events := make(chan Event)
+	srv := newMockKubeServer(t,
+		withMockList("5", newTestSlice("svc-a", 8080, "10.0.0.1")),
+		withMockEvents(events))
+	defer srv.Close()
+
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	rs, err := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithBackoff(10*time.Millisecond, 10*time.Millisecond)).
+		Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	<-fc.cmp
+
+	fc.mu.Lock()
+	fc.found = nil
+	fc.mu.Unlock()
+
+	events <- Event{Type: Modified, Object: modified}
+
+	<-fc.cmp
+	assert.Equal(t, []string{"10.0.0.2:8080"}, fc.addresses())
+
+	// the watch is closed and resumed from the last event
+	events <- Event{}
+
+	// the resourceVersion expired, the slices are listed again
+	events <- Event{Type: Error, Status: &Status{
+		Status:  "Failure",
+		Message: "too old resource version: 7 (9)",
+		Reason:  StatusReasonExpired,
+		Code:    http.StatusGone,
+	}}
+
+	assert.Eventually(t, func() bool { return srv.lists.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"list", "watch 5", "watch 7", "list"}, srv.calls()[:4])
+}
+
+func TestStalledWatchIsRestarted(t *testing.T) {
+	// the watch stays open without sending anything, like a connection
+	// dropped behind a NAT
+	srv := newMockKubeServer(t, withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(reg),
+		WithWatchIdleTimeout(100*time.Millisecond),
+		WithBackoff(10*time.Millisecond, 10*time.Millisecond))
+
+	rs, err := b.Build(parseTarget("kubernetes:///svc.ns:8080"), &fakeConn{cmp: make(chan struct{}, 1)}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	// the stalled watch is torn down and the slices are listed again
+	assert.Eventually(t, func() bool { return srv.lists.Load() >= 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricsFor(reg).watchFailures.WithLabelValues("kubernetes://ns/svc:8080", "stalled")) >= 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReportError(t *testing.T) {
+	tests := []struct {
+		name     string
+		list     int
+		items    []EndpointSlice
+		watch    int
+		failures int
+		want     string
+	}{
+		{
+			name:     "forbidden list",
+			list:     http.StatusForbidden,
+			watch:    http.StatusOK,
+			failures: 1,
+			want:     "invalid response code 403",
+		},
+		{
+			name:  "missing service",
+			list:  http.StatusOK,
+			watch: http.StatusOK,
+			want:  ErrNoEndpoints.Error(),
+		},
+		{
+			name:     "persistent watch failure",
+			list:     http.StatusOK,
+			items:    []EndpointSlice{newTestSlice("svc-a", 8080, "10.0.0.1")},
+			watch:    http.StatusForbidden,
+			failures: persistentFailures,
+			want:     "invalid response code 403",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newMockKubeServer(t,
+				withMockList("1", tt.items...),
+				withMockStatus(tt.list, tt.watch))
+			defer srv.Close()
+
+			b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+				WithRegisterer(prometheus.NewRegistry()),
+				WithBackoff(10*time.Millisecond, 10*time.Millisecond))
+
+			fc := &fakeConn{cmp: make(chan struct{}, 1)}
+
+			rs, err := b.Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rs.Close()
+
+			assert.Eventually(t, func() bool { return len(fc.reportedErrors()) > 0 }, 5*time.Second, 10*time.Millisecond)
+
+			var se *SyncError
+
+			require.ErrorAs(t, fc.reportedErrors()[0], &se)
+			assert.Equal(t, "ns", se.Namespace)
+			assert.Equal(t, "svc", se.Service)
+			assert.Equal(t, tt.failures, se.Failures)
+			assert.ErrorContains(t, se, tt.want)
+
+			// transient failures of a synced resolver are not reported
+			if tt.items != nil {
+				assert.Equal(t, []string{"10.0.0.1:8080"}, fc.addresses())
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{initial: time.Second, max: 30 * time.Second, jitter: 1}
+
+	// the period doubles up to max without wrapping around
+	period := b.initial
+	for range 10 {
+		period = b.next(period)
+	}
+
+	assert.Equal(t, b.max, period)
+
+	for range 100 {
+		d := b.wait(period)
+		assert.GreaterOrEqual(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, period)
+	}
+
+	b.jitter = 0
+	assert.Equal(t, period, b.wait(period))
+
+	b.jitter = 0.5
+	assert.GreaterOrEqual(t, b.wait(period), period/2)
+}
+
+func TestBackoffResetsAfterHealthyRun(t *testing.T) {
+	b := backoff{initial: 20 * time.Millisecond, max: time.Second, healthy: 50 * time.Millisecond}
+	stopCh := make(chan struct{})
+	starts := make(chan time.Time, 4)
+
+	var runs int
+
+	go until(func() time.Duration {
+		starts <- time.Now()
+		runs++
+
+		switch runs {
+		case 3:
+			// a healthy run resets the backoff grown by the two failures
+			return b.healthy
+		case 4:
+			close(stopCh)
+		}
+
+		return 0
+	}, b, stopCh, newGrpclogLogger())
+
+	var start [4]time.Time
+	for i := range start {
+		start[i] = <-starts
+	}
+
+	// 20ms and 40ms after the failures, the period would be 80ms without
+	// the reset
+	assert.GreaterOrEqual(t, start[2].Sub(start[1]), 40*time.Millisecond)
+	assert.Less(t, start[3].Sub(start[2]), 60*time.Millisecond)
+}
+
+func TestBackoffGrowsWithSlowFailingLists(t *testing.T) {
+	srv := newMockKubeServer(t,
+		withMockStatus(http.StatusInternalServerError, http.StatusOK),
+		withMockListDelay(60*time.Millisecond))
+	defer srv.Close()
+
+	rs, err := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithBackoff(20*time.Millisecond, time.Second),
+		WithBackoffJitter(0),
+		WithBackoffReset(50*time.Millisecond)).
+		Build(parseTarget("kubernetes:///svc.ns:8080"), &fakeConn{cmp: make(chan struct{}, 1)}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	assert.Eventually(t, func() bool { return srv.lists.Load() >= 4 }, 5*time.Second, 10*time.Millisecond)
+
+	// lists failing after longer than the reset period are not healthy runs,
+	// the delay doubles from 20ms to 40ms and 80ms
+	times := srv.times()
+	assert.GreaterOrEqual(t, times[3].Sub(times[2])-times[1].Sub(times[0]), 40*time.Millisecond)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	srv := newMockKubeServer(t,
+		withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")),
+		withMockListDelay(20*time.Millisecond))
+	defer srv.Close()
+
+	b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithMaxConcurrentRequests(1))
+
+	conns := make([]*fakeConn, 3)
+
+	for i := range conns {
+		conns[i] = &fakeConn{cmp: make(chan struct{}, 1)}
+
+		rs, err := b.Build(parseTarget(fmt.Sprintf("kubernetes:///svc%d.ns:8080", i)), conns[i], resolver.BuildOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Close()
+	}
+
+	for _, fc := range conns {
+		<-fc.cmp
+	}
+
+	// open watches do not hold on to the limit
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), srv.maxInflightLists.Load())
+}
+
+func TestMaxConcurrentRequestsWithUnansweredWatch(t *testing.T) {
+	srv := newMockKubeServer(t,
+		withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")),
+		withMockWatchHang())
+	defer srv.Close()
+
+	b := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithMaxConcurrentRequests(1),
+		WithWatchIdleTimeout(100*time.Millisecond),
+		WithBackoff(time.Second, time.Second))
+
+	for i := range 2 {
+		fc := &fakeConn{cmp: make(chan struct{}, 1)}
+
+		rs, err := b.Build(parseTarget(fmt.Sprintf("kubernetes:///svc%d.ns:8080", i)), fc, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Close()
+
+		// the unanswered watch of the first resolver gives up its slot after
+		// the idle timeout, so that the second one can list
+		select {
+		case <-fc.cmp:
+		case <-time.After(5 * time.Second):
+			t.Fatal("resolver was blocked by an unanswered watch")
+		}
+
+		if i == 0 {
+			assert.Eventually(t, func() bool { return srv.openWatches.Load() == 1 }, time.Second, 10*time.Millisecond)
+		}
+	}
+}
+
+func TestLimitedClientHoldsListUntilRead(t *testing.T) {
+	srv := newMockKubeServer(t)
+	defer srv.Close()
+
+	sem := make(chan struct{}, 1)
+	client := &limitedClient{K8sClient: NewInsecureK8sClient(srv.URL), sem: sem}
+
+	req, err := client.GetRequest(srv.URL + "/apis/discovery.k8s.io/v1/namespaces/ns/endpointslices")
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Len(t, sem, 1, "the list holds its slot while the body is read")
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, resp.Body.Close())
+	assert.Empty(t, sem)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err = client.GetRequest(srv.URL + "/apis/discovery.k8s.io/v1/watch/namespaces/ns/endpointslices")
+	require.NoError(t, err)
+
+	resp, err = client.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	assert.Empty(t, sem, "an answered watch releases its slot")
+
+	_ = resp.Body.Close()
+}
+
+func TestResolveNowIsRateLimited(t *testing.T) {
+	srv := newMockKubeServer(t, withMockList("1", newTestSlice("svc-a", 8080, "10.0.0.1")))
+	defer srv.Close()
+
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	bl := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithResolveNowInterval(200*time.Millisecond))
+
+	rs, err := bl.Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	<-fc.cmp
+
+	for range 10 {
+		rs.ResolveNow(resolver.ResolveNowOptions{})
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, int32(2), srv.lists.Load())
+}
+
+func TestResyncRestartsWatch(t *testing.T) {
+	srv := newMockKubeServer(t, withMockList("42", newTestSlice("svc-a", 8080, "10.0.0.1")))
+	defer srv.Close()
+
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	rs, err := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithResolveNowInterval(time.Millisecond)).
+		Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	<-fc.cmp
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	rs.ResolveNow(resolver.ResolveNowOptions{})
+
+	// the stream opened before the relist is replaced by one resuming from
+	// the listed resourceVersion
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 2 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return srv.openWatches.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), srv.lists.Load())
+
+	queries := srv.queries()
+	if assert.Len(t, queries, 4) {
+		assert.Equal(t, "42", queries[3].Get("resourceVersion"))
+	}
+}
+
+func TestResyncFailureIsRecorded(t *testing.T) {
+	srv := newMockKubeServer(t,
+		withMockList("42", newTestSlice("svc-a", 8080, "10.0.0.1")),
+		withMockResyncStatus(http.StatusForbidden))
+	defer srv.Close()
+
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	reg := prometheus.NewRegistry()
+	bl := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(reg),
+		WithResolveNowInterval(time.Millisecond))
+
+	rs, err := bl.Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	<-fc.cmp
+	assert.Eventually(t, func() bool { return srv.watches.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	rs.ResolveNow(resolver.ResolveNowOptions{})
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricsFor(reg).watchFailures.WithLabelValues("kubernetes://ns/svc:8080", "forbidden")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	if snapshots := bl.Snapshot(); assert.Len(t, snapshots, 1) {
+		assert.Contains(t, snapshots[0].LastError, "403")
+	}
+
+	// the watch is kept, the resolver keeps its addresses
+	assert.Equal(t, int32(1), srv.watches.Load())
+	assert.Equal(t, []string{"10.0.0.1:8080"}, fc.addresses())
+}
+
+func TestBuilderWithOptions(t *testing.T) {
+	zoneA, zoneB := "a", "b"
+	slice := newTestSlice("svc-a", 8080, "10.0.0.1")
+	slice.Endpoints[0].Zone = &zoneA
+	other := newTestSlice("svc-b", 8080, "10.0.0.2")
+	other.Endpoints[0].Zone = &zoneB
+
+	srv := newMockKubeServer(t, withMockList("1", slice, other))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	bl := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithRegisterer(reg),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithEndpointFilter(func(e Endpoint) bool {
+			return e.Zone != nil && *e.Zone == zoneA
+		}),
+	)
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	rs, err := bl.Build(parseTarget("kubernetes:///svc.ns:8080"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-fc.cmp
+	assert.Equal(t, []string{"10.0.0.1:8080"}, fc.addresses())
+
+	count, err := testutil.GatherAndCount(reg, "kuberesolver_addresses_total")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// a second builder on the same registry shares its collectors
+	bl2 := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema, WithRegisterer(reg))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metricsFor(reg).watchStarts.WithLabelValues("kubernetes://ns/svc:8080")))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metricsFor(reg).requests.WithLabelValues(verbList, "200")))
+
+	rs2, err := bl2.Build(parseTarget("kubernetes:///svc.ns:8080"), &fakeConn{cmp: make(chan struct{}, 1)}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs.Close()
+
+	count, err = testutil.GatherAndCount(reg, "kuberesolver_addresses_total")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "series must be kept while a resolver of the target is open")
+
+	rs2.Close()
+
+	count, err = testutil.GatherAndCount(reg, "kuberesolver_addresses_total")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "series must be deleted with the last resolver of the target")
+}
+
+func TestClosedTargetSeriesAreNotRecreated(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := metricsFor(reg)
+	target := "kubernetes://ns/svc:8080"
+
+	m.acquire(target)
+	m.observeWatchStart(target)
+	m.observeEvent(target, Added)
+	m.observeWatchFailure(target, "stalled")
+	m.release(target)
+
+	// observations of an informer racing with the close of the resolver
+	m.observeWatchStart(target)
+	m.observeEvent(target, Added)
+	m.observeWatchFailure(target, "stalled")
+
+	for _, name := range []string{
+		"kuberesolver_watch_starts_total",
+		"kuberesolver_watch_events_total",
+		"kuberesolver_watch_failures_total",
+		"kuberesolver_seconds_since_last_watch_event",
+	} {
+		count, err := testutil.GatherAndCount(reg, name)
+		assert.NoError(t, err)
+		assert.Zero(t, count, name)
+	}
+}
+
+func TestInvalidOptionsAreIgnored(t *testing.T) {
+	b := NewBuilderWithOptions(nil, kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithResyncPeriod(0),
+		WithBackoff(0, time.Second),
+		WithBackoffReset(-1))
+	assert.Equal(t, defaultFreq, b.resyncPeriod)
+	assert.Equal(t, backoff{initial: defaultBackoffInitial, max: defaultBackoffMax, jitter: 1, healthy: defaultBackoffHealthy}, b.backoff)
+
+	// the maximum delay is never below the initial one
+	b = NewBuilderWithOptions(nil, kubernetesSchema,
+		WithRegisterer(prometheus.NewRegistry()),
+		WithBackoff(time.Second, -1))
+	assert.Equal(t, time.Second, b.backoff.max)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	b = NewBuilderWithOptions(nil, kubernetesSchema,
+		WithRegisterer(nil),
+		WithLogger(logger),
+		WithLogger(nil))
+	assert.Same(t, logger, b.logger)
+	assert.NotNil(t, b.metrics)
+}
+
+func TestBuilderSnapshot(t *testing.T) {
+	srv := newMockKubeServer(t)
+	defer srv.Close()
+
+	bl := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema, WithRegisterer(prometheus.NewRegistry()))
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	rs, err := bl.Build(parseTarget("kubernetes:///kube-dns.kube-system:53"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-fc.cmp
+
+	snapshots := bl.Snapshot()
+	if assert.Len(t, snapshots, 1) {
+		s := snapshots[0]
+		assert.Equal(t, "kubernetes://kube-system/kube-dns:53", s.Target)
+		assert.Equal(t, []string{"10.0.0.1:53", "10.0.0.2:53"}, s.Addresses)
+		assert.False(t, s.LastUpdate.IsZero())
+
+		if assert.Len(t, s.Slices, 1) {
+			assert.Equal(t, s.Addresses, s.Slices[0].Addresses)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	bl.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/kuberesolver?format=json", nil))
+
+	var decoded []ResolverSnapshot
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &decoded))
+
+	if assert.Len(t, decoded, 1) {
+		assert.Equal(t, "kubernetes://kube-system/kube-dns:53", decoded[0].Target)
+		assert.NotEmpty(t, decoded[0].History)
+	}
+
+	rec = httptest.NewRecorder()
+	bl.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/kuberesolver", nil))
+	assert.Contains(t, rec.Body.String(), "<h2>kubernetes://kube-system/kube-dns:53</h2>")
+	assert.Contains(t, rec.Body.String(), "10.0.0.2:53")
+
+	rs.Close()
+	assert.Empty(t, bl.Snapshot())
+}
+
 // copied from grpc package to test parsing endpoints
 
 func parseTarget(target string) resolver.Target {
@@ -0,0 +1,107 @@
+package kuberesolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloader holds a client certificate loaded from files and reloads it
+// whenever one of the files changes, so that rotated certificates are used
+// for new connections without restarting the process.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	watcher  *fsnotify.Watcher
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := watchFiles(func() {
+		// the certificate and the key are not replaced atomically, a
+		// mismatching pair is ignored until the other file is written
+		_ = r.reload()
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.watcher = watcher
+
+	return r, nil
+}
+
+// Close stops watching the files.
+func (r *certReloader) Close() error {
+	return r.watcher.Close()
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load client certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+
+	return nil
+}
+
+// clientCertificate is a tls.Config.GetClientCertificate callback returning
+// the last loaded certificate.
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// NewK8sClientWithClientCert creates a K8sClient authenticating to the
+// apiserver at apiURL with an x509 client certificate. The certificate and
+// key are reloaded from certFile and keyFile whenever they are rotated. If
+// caFile is empty the system roots verify the apiserver.
+func NewK8sClientWithClientCert(apiURL, caFile, certFile, keyFile string) (K8sClient, error) {
+	return NewK8sClientWithClientCertWithOptions(apiURL, caFile, certFile, keyFile, ClientOptions{})
+}
+
+// NewK8sClientWithClientCertWithOptions is NewK8sClientWithClientCert with
+// the connections to the apiserver configured by opts.
+func NewK8sClientWithClientCertWithOptions(apiURL, caFile, certFile, keyFile string, opts ClientOptions) (K8sClient, error) {
+	tlsConfig, err := newTLSConfig(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.GetClientCertificate = reloader.clientCertificate
+
+	httpClient, err := newHTTPClient(tlsConfig, opts)
+	if err != nil {
+		_ = reloader.Close()
+		return nil, err
+	}
+
+	return &k8sClient{
+		host:       strings.TrimSuffix(apiURL, "/"),
+		httpClient: httpClient,
+		closers:    []io.Closer{reloader},
+	}, nil
+}
@@ -0,0 +1,34 @@
+package kuberesolver
+
+import (
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertIsReloaded(t *testing.T) {
+	srv := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	caFile := writeFile(t, dir, "ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	cert, key := newTestCert(t, "alice")
+	certFile := writeFile(t, dir, "tls.crt", string(cert))
+	keyFile := writeFile(t, dir, "tls.key", string(key))
+
+	client, err := NewK8sClientWithClientCert(srv.URL, caFile, certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", doTestRequest(t, client).Header.Get("X-Client-Cn"))
+
+	// rotate the certificate, new connections use the new one
+	cert, key = newTestCert(t, "bob")
+	writeFile(t, dir, "tls.key", string(key))
+	writeFile(t, dir, "tls.crt", string(cert))
+
+	assert.Eventually(t, func() bool {
+		client.(*k8sClient).httpClient.CloseIdleConnections()
+		return doTestRequest(t, client).Header.Get("X-Client-Cn") == "bob"
+	}, 5*time.Second, 20*time.Millisecond)
+}
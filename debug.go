@@ -0,0 +1,103 @@
+package kuberesolver
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DebugHandler returns an http.Handler rendering the Snapshot of the builder,
+// e.g. to be served at /debug/kuberesolver. The state is rendered as HTML,
+// or as JSON if requested with ?format=json or an Accept: application/json
+// header.
+func (b *Builder) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshots := b.Snapshot()
+
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(snapshots)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = debugTemplate.Execute(w, snapshots)
+	})
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+	"cond": func(b *bool) string {
+		if b == nil {
+			return "-"
+		}
+
+		if *b {
+			return "true"
+		}
+
+		return "false"
+	},
+	"str": func(s *string) string {
+		if s == nil {
+			return "-"
+		}
+
+		return *s
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>kuberesolver</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>kuberesolver</h1>
+{{if not .}}<p>No active resolvers.</p>{{end}}
+{{range .}}
+<h2>{{.Target}}</h2>
+<table>
+<tr><th>Namespace</th><td>{{.Namespace}}</td></tr>
+<tr><th>Service</th><td>{{.Service}}</td></tr>
+<tr><th>Port</th><td>{{if .UseFirstPort}}first port{{else}}{{.Port}}{{if .ResolveByPortName}} (by name){{end}}{{end}}</td></tr>
+<tr><th>Addresses</th><td>{{range .Addresses}}{{.}}<br>{{else}}none{{end}}</td></tr>
+<tr><th>Last update</th><td>{{since .LastUpdate}}</td></tr>
+<tr><th>Resource version</th><td>{{.ResourceVersion}}</td></tr>
+<tr><th>Watch</th><td>{{if .Watch.Active}}active since {{since .Watch.Started}}{{else}}inactive{{end}}, {{.Watch.Starts}} starts, last event {{since .Watch.LastEvent}}</td></tr>
+<tr><th>Last error</th><td>{{if .LastError}}<span class="error">{{.LastError}}</span> ({{since .LastErrorTime}}){{else}}none{{end}}</td></tr>
+</table>
+<h3>Endpoint slices</h3>
+<table>
+<tr><th>Slice</th><th>Addresses</th><th>Ready</th><th>Serving</th><th>Terminating</th><th>Zone</th><th>Node</th></tr>
+{{range $s := .Slices}}{{range .Endpoints}}
+<tr><td>{{$s.Name}}</td><td>{{range .Addresses}}{{.}} {{end}}</td><td>{{cond .Conditions.Ready}}</td><td>{{cond .Conditions.Serving}}</td><td>{{cond .Conditions.Terminating}}</td><td>{{str .Zone}}</td><td>{{str .NodeName}}</td></tr>
+{{end}}{{end}}
+</table>
+<h3>Recent updates</h3>
+<table>
+<tr><th>Time</th><th>Resource version</th><th>Addresses</th></tr>
+{{range .History}}
+<tr><td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.ResourceVersion}}</td><td>{{range .Addresses}}{{.}} {{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
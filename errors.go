@@ -0,0 +1,167 @@
+package kuberesolver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxStatusSize bounds the part of an error response read for its Status.
+const maxStatusSize = 64 << 10
+
+// errWatchStalled is returned when a watch received neither events nor
+// bookmarks within the watch idle timeout.
+var errWatchStalled = errors.New("watch stalled")
+
+// errResynced is returned by a watch that relisted the slices, so that it is
+// restarted from the listed resourceVersion.
+var errResynced = errors.New("watch resynced")
+
+// errBuilderClosed is returned by Build once the builder is closed.
+var errBuilderClosed = errors.New("kuberesolver: builder is closed")
+
+// ErrNoEndpoints is wrapped by the SyncError reported when the EndpointSlices
+// of a target were listed but hold no address to connect to.
+var ErrNoEndpoints = errors.New("no endpoint addresses found")
+
+// SyncError is reported to the gRPC ClientConn when the endpoints of a target
+// can not be resolved: before the EndpointSlices could be listed for the first
+// time, when the watch keeps failing, or when no address was found.
+type SyncError struct {
+	Namespace string
+	Service   string
+	// Failures is the number of consecutive failures of the watch, zero if
+	// the EndpointSlices were listed but no address was found.
+	Failures int
+	Err      error
+}
+
+func (e *SyncError) Error() string {
+	if e.Failures > 1 {
+		return fmt.Sprintf("kuberesolver: unable to resolve service %s in namespace %s after %d attempts: %v", e.Service, e.Namespace, e.Failures, e.Err)
+	}
+
+	return fmt.Sprintf("kuberesolver: unable to resolve service %s in namespace %s: %v", e.Service, e.Namespace, e.Err)
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is the error reported by the apiserver with a Status object,
+// e.g. in an ERROR watch event.
+type StatusError struct {
+	Status Status
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("kubernetes api error: code=%d reason=%s message=%q", e.Status.Code, e.Status.Reason, e.Status.Message)
+}
+
+// APIError is returned when the apiserver answers a list or watch of the
+// EndpointSlices of a service with an error status. Reason and Message are
+// read from the Status object of the response body if there is one.
+type APIError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	Reason     StatusReason
+	Message    string
+	Namespace  string
+	Service    string
+}
+
+// newAPIError returns the APIError of a response with an error status.
+func newAPIError(resp *http.Response, namespace, service string) *APIError {
+	e := &APIError{
+		StatusCode: resp.StatusCode,
+		Namespace:  namespace,
+		Service:    service,
+	}
+
+	var status Status
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxStatusSize)).Decode(&status); err == nil {
+		e.Reason = status.Reason
+		e.Message = status.Message
+	}
+
+	if e.Reason == "" {
+		e.Reason = reasonForCode(resp.StatusCode)
+	}
+
+	return e
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("invalid response code %d for service %s in namespace %s", e.StatusCode, e.Service, e.Namespace)
+	if e.Reason != "" {
+		msg += ": " + string(e.Reason)
+	}
+
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+
+	return msg
+}
+
+// reasonForCode returns the reason of a response without Status object.
+func reasonForCode(code int) StatusReason {
+	switch code {
+	case http.StatusUnauthorized:
+		return StatusReasonUnauthorized
+	case http.StatusForbidden:
+		return StatusReasonForbidden
+	case http.StatusNotFound:
+		return StatusReasonNotFound
+	case http.StatusGone:
+		return StatusReasonGone
+	case http.StatusInternalServerError:
+		return StatusReasonInternal
+	default:
+		return ""
+	}
+}
+
+// statusOf returns the status code and reason of an APIError or StatusError
+// in the chain of err.
+func statusOf(err error) (int, StatusReason, bool) {
+	var (
+		ae *APIError
+		se *StatusError
+	)
+
+	switch {
+	case errors.As(err, &ae):
+		return ae.StatusCode, ae.Reason, true
+	case errors.As(err, &se):
+		return se.Status.Code, se.Status.Reason, true
+	default:
+		return 0, "", false
+	}
+}
+
+// IsForbidden reports whether err was caused by the apiserver denying the
+// request, e.g. because RBAC does not allow to list EndpointSlices.
+func IsForbidden(err error) bool {
+	code, reason, ok := statusOf(err)
+
+	return ok && (code == http.StatusForbidden || reason == StatusReasonForbidden)
+}
+
+// IsNotFound reports whether err was caused by the apiserver not finding the
+// requested resource.
+func IsNotFound(err error) bool {
+	code, reason, ok := statusOf(err)
+
+	return ok && (code == http.StatusNotFound || reason == StatusReasonNotFound)
+}
+
+// IsGone reports whether err was caused by a resourceVersion no longer
+// available on the apiserver, the EndpointSlices must be listed again.
+func IsGone(err error) bool {
+	code, reason, ok := statusOf(err)
+
+	return ok && (code == http.StatusGone || reason == StatusReasonGone || reason == StatusReasonExpired)
+}
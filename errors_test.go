@@ -0,0 +1,71 @@
+package kuberesolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/watch/"):
+			w.WriteHeader(http.StatusGone)
+		case strings.Contains(r.URL.Path, "/namespaces/denied/"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(Status{
+				Status:  "Failure",
+				Message: `endpointslices.discovery.k8s.io is forbidden: User "system:serviceaccount:ns:default" cannot list resource "endpointslices"`,
+				Reason:  StatusReasonForbidden,
+				Code:    http.StatusForbidden,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewInsecureK8sClient(srv.URL)
+
+	_, err := getEndpointSliceList(context.Background(), client, "denied", "svc")
+
+	var ae *APIError
+
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, http.StatusForbidden, ae.StatusCode)
+	assert.Equal(t, StatusReasonForbidden, ae.Reason)
+	assert.Equal(t, "denied", ae.Namespace)
+	assert.Equal(t, "svc", ae.Service)
+	assert.Contains(t, ae.Message, "cannot list resource")
+	assert.True(t, IsForbidden(err))
+	assert.False(t, IsNotFound(err))
+	assert.Equal(t, "forbidden", failureReason(err))
+
+	// the reason of a response without Status object follows the code
+	_, err = getEndpointSliceList(context.Background(), client, "ns", "svc")
+	assert.True(t, IsNotFound(fmt.Errorf("lookup endpoints failed: %w", err)))
+	assert.EqualError(t, err, "invalid response code 404 for service svc in namespace ns: NotFound")
+	assert.Equal(t, "not_found", failureReason(err))
+
+	_, err = watchEndpointSlice(context.Background(), client, "ns", "svc", "1", 0)
+	assert.True(t, IsGone(err))
+	assert.Equal(t, "expired", failureReason(err))
+
+	// Status objects of watch events are checked as well
+	assert.True(t, IsGone(&StatusError{Status: Status{Code: http.StatusGone, Reason: StatusReasonExpired}}))
+	assert.False(t, IsForbidden(errors.New("forbidden")))
+
+	// failure reasons share one vocabulary
+	assert.Equal(t, "internal", failureReason(&StatusError{Status: Status{Code: http.StatusInternalServerError, Reason: StatusReasonInternal}}))
+	assert.Equal(t, "too_many_requests", failureReason(&StatusError{Status: Status{Code: http.StatusTooManyRequests, Reason: "TooManyRequests"}}))
+	assert.Equal(t, "unknown", failureReason(errors.New("forbidden")))
+}
@@ -0,0 +1,233 @@
+package kuberesolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// execTimeout bounds the run time of an exec credential plugin.
+const execTimeout = time.Minute
+
+// execConfig is the exec section of a kubeconfig user, running a
+// client.authentication.k8s.io credential plugin.
+type execConfig struct {
+	APIVersion         string    `yaml:"apiVersion"`
+	Command            string    `yaml:"command"`
+	Args               []string  `yaml:"args"`
+	Env                []execEnv `yaml:"env"`
+	ProvideClusterInfo bool      `yaml:"provideClusterInfo"`
+	InstallHint        string    `yaml:"installHint"`
+}
+
+type execEnv struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// execCredential is the object exchanged with a credential plugin.
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Spec       execCredentialSpec    `json:"spec"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialSpec struct {
+	Interactive bool         `json:"interactive"`
+	Cluster     *execCluster `json:"cluster,omitempty"`
+}
+
+type execCluster struct {
+	Server                   string `json:"server"`
+	TLSServerName            string `json:"tls-server-name,omitempty"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify,omitempty"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data,omitempty"`
+}
+
+type execCredentialStatus struct {
+	Token                 string     `json:"token"`
+	ExpirationTimestamp   *time.Time `json:"expirationTimestamp"`
+	ClientCertificateData string     `json:"clientCertificateData"`
+	ClientKeyData         string     `json:"clientKeyData"`
+}
+
+// execProvider runs a credential plugin and caches its credentials until
+// they expire.
+type execProvider struct {
+	config  execConfig
+	cluster *execCluster
+
+	mu     sync.Mutex
+	token  string
+	cert   *tls.Certificate
+	expiry time.Time
+	// valid is cleared when the credentials expire or are rejected.
+	valid bool
+}
+
+func newExecProvider(config execConfig, cluster *execCluster, dir string) (*execProvider, error) {
+	if config.Command == "" {
+		return nil, fmt.Errorf("exec plugin has no command")
+	}
+
+	switch config.APIVersion {
+	case "client.authentication.k8s.io/v1", "client.authentication.k8s.io/v1beta1":
+	default:
+		return nil, fmt.Errorf("exec plugin apiVersion %q is not supported", config.APIVersion)
+	}
+
+	// like kubectl, commands given with a relative path are relative to the
+	// kubeconfig file, others are looked up in PATH
+	if strings.ContainsRune(config.Command, filepath.Separator) {
+		config.Command = resolvePath(dir, config.Command)
+	}
+
+	p := &execProvider{config: config}
+	if config.ProvideClusterInfo {
+		p.cluster = cluster
+	}
+
+	return p, nil
+}
+
+// credentials returns the cached credentials, running the plugin if they are
+// missing or expired.
+func (p *execProvider) credentials() (string, *tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.valid && (p.expiry.IsZero() || time.Now().Before(p.expiry)) {
+		return p.token, p.cert, nil
+	}
+
+	status, err := p.run()
+	if err != nil {
+		return "", nil, err
+	}
+
+	p.token = status.Token
+	p.cert = nil
+	p.expiry = time.Time{}
+
+	if status.ExpirationTimestamp != nil {
+		p.expiry = *status.ExpirationTimestamp
+	}
+
+	if status.ClientCertificateData != "" || status.ClientKeyData != "" {
+		cert, err := tls.X509KeyPair([]byte(status.ClientCertificateData), []byte(status.ClientKeyData))
+		if err != nil {
+			return "", nil, fmt.Errorf("exec plugin %s returned an invalid client certificate: %w", p.config.Command, err)
+		}
+
+		p.cert = &cert
+	}
+
+	p.valid = true
+
+	return p.token, p.cert, nil
+}
+
+// Token implements TokenSource.
+func (p *execProvider) Token() (string, error) {
+	token, _, err := p.credentials()
+
+	return token, err
+}
+
+// invalidate makes the next request run the plugin again, after the
+// apiserver rejected the credentials.
+func (p *execProvider) invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.valid = false
+}
+
+// clientCertificate is a tls.Config.GetClientCertificate callback using the
+// certificate returned by the plugin. Connections are made right after
+// GetRequest refreshed the credentials, so the cached certificate is used as
+// long as it was not rejected.
+func (p *execProvider) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	p.mu.Lock()
+	cert, valid := p.cert, p.valid
+	p.mu.Unlock()
+
+	if !valid {
+		var err error
+		if _, cert, err = p.credentials(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cert == nil {
+		// no certificate is sent
+		return &tls.Certificate{}, nil
+	}
+
+	return cert, nil
+}
+
+// run executes the plugin and returns the status of its ExecCredential.
+func (p *execProvider) run() (*execCredentialStatus, error) {
+	info, err := json.Marshal(execCredential{
+		APIVersion: p.config.APIVersion,
+		Kind:       "ExecCredential",
+		Spec:       execCredentialSpec{Cluster: p.cluster},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.config.Command, p.config.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+
+	for _, env := range p.config.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if p.config.InstallHint != "" && isCommandNotFound(err) {
+			return nil, fmt.Errorf("exec plugin %s: %w\n%s", p.config.Command, err, p.config.InstallHint)
+		}
+
+		return nil, fmt.Errorf("exec plugin %s failed: %w: %s", p.config.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var cred execCredential
+	if err := json.Unmarshal(stdout.Bytes(), &cred); err != nil {
+		return nil, fmt.Errorf("exec plugin %s returned an invalid ExecCredential: %w", p.config.Command, err)
+	}
+
+	if cred.APIVersion != p.config.APIVersion {
+		return nil, fmt.Errorf("exec plugin %s returned apiVersion %q, expected %q", p.config.Command, cred.APIVersion, p.config.APIVersion)
+	}
+
+	if cred.Status == nil || (cred.Status.Token == "" && cred.Status.ClientCertificateData == "") {
+		return nil, fmt.Errorf("exec plugin %s returned no credentials", p.config.Command)
+	}
+
+	return cred.Status, nil
+}
+
+func isCommandNotFound(err error) bool {
+	var execErr *exec.Error
+
+	return errors.As(err, &execErr)
+}
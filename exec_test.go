@@ -0,0 +1,106 @@
+package kuberesolver
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeExecPlugin writes a credential plugin that counts its runs and prints
+// a token expiring after ttl.
+func writeExecPlugin(t *testing.T, dir string, ttl time.Duration) string {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("exec plugin test uses a shell script")
+	}
+
+	expiry := time.Now().Add(ttl).UTC().Format(time.RFC3339)
+
+	return writeFile(t, dir, "plugin.sh", `#!/bin/sh
+echo run >> "$(dirname "$0")/runs"
+case "$KUBERNETES_EXEC_INFO" in
+  *'"server":"https://'*) ;;
+  *) echo "missing cluster info" >&2; exit 1 ;;
+esac
+cat <<JSON
+{
+  "apiVersion": "client.authentication.k8s.io/v1",
+  "kind": "ExecCredential",
+  "status": {"token": "$TOKEN_PREFIX-$(wc -l < "$(dirname "$0")/runs" | tr -d ' ')", "expirationTimestamp": "`+expiry+`"}
+}
+JSON
+`)
+}
+
+func newExecTestClient(t *testing.T, ttl time.Duration) (K8sClient, string) {
+	t.Helper()
+
+	srv := newTestAPIServer(t)
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(writeExecPlugin(t, dir, ttl), 0o700))
+
+	path := writeFile(t, dir, "config", `
+current-context: cloud
+clusters:
+- name: cloud
+  cluster:
+    server: `+srv.URL+`
+    certificate-authority-data: `+caData(srv)+`
+users:
+- name: cloud
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: ./plugin.sh
+      provideClusterInfo: true
+      env:
+      - name: TOKEN_PREFIX
+        value: cloud
+contexts:
+- name: cloud
+  context:
+    cluster: cloud
+    user: cloud
+`)
+
+	client, err := NewK8sClientFromKubeconfig(path, "")
+	require.NoError(t, err)
+
+	return client, dir
+}
+
+func execRuns(t *testing.T, dir string) int {
+	t.Helper()
+
+	runs, err := os.ReadFile(filepath.Join(dir, "runs"))
+	require.NoError(t, err)
+
+	return strings.Count(string(runs), "run")
+}
+
+func TestExecCredentialIsCached(t *testing.T) {
+	client, dir := newExecTestClient(t, time.Hour)
+
+	assert.Equal(t, "Bearer cloud-1", doTestRequest(t, client).Header.Get("X-Authorization"))
+	assert.Equal(t, "Bearer cloud-1", doTestRequest(t, client).Header.Get("X-Authorization"))
+	assert.Equal(t, 1, execRuns(t, dir))
+
+	// a rejected token is refreshed before it expires
+	client.(*k8sClient).exec.invalidate()
+	assert.Equal(t, "Bearer cloud-2", doTestRequest(t, client).Header.Get("X-Authorization"))
+}
+
+func TestExecCredentialIsRefreshedOnExpiry(t *testing.T) {
+	client, dir := newExecTestClient(t, -time.Minute)
+
+	assert.Equal(t, "Bearer cloud-1", doTestRequest(t, client).Header.Get("X-Authorization"))
+	assert.Equal(t, "Bearer cloud-2", doTestRequest(t, client).Header.Get("X-Authorization"))
+	assert.Equal(t, 2, execRuns(t, dir))
+}
@@ -0,0 +1,618 @@
+package kuberesolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// informerKey identifies the EndpointSlices watched by an informer. An empty
+// service selects every EndpointSlice of the namespace owned by a service.
+type informerKey struct {
+	namespace string
+	service   string
+}
+
+// sliceState is the state of the EndpointSlices of a service handed to the
+// resolvers. The slices map must not be modified.
+type sliceState struct {
+	// generation increases with every change, resolvers ignore states older
+	// than the last one they applied.
+	generation      uint64
+	resourceVersion string
+	slices          map[string]EndpointSlice
+}
+
+// informer lists and watches the EndpointSlices of a service, or of a whole
+// namespace, and hands every change to the resolvers subscribed to the
+// service of the changed slice. All resolvers of a builder for the same
+// service share one informer, so that each service is watched only once
+// however many ClientConns use it.
+type informer struct {
+	key       informerKey
+	k8sClient K8sClient
+	logger    *slog.Logger
+	metrics   *metrics
+	recorder  multiRecorder
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wg is used to enforce stop() to return after the watch goroutine has finished.
+	wg   sync.WaitGroup
+	t    *time.Timer
+	freq time.Duration
+
+	watchTimeout time.Duration
+	// idleTimeout is the time without events or bookmarks after which the
+	// watch is considered dead, zero to disable the check.
+	idleTimeout time.Duration
+	// resolveNow is signaled by ResolveNow, requests are coalesced while one
+	// is pending and lists are done at most once per resolveNowFreq.
+	resolveNow     chan struct{}
+	resolveNowFreq time.Duration
+	lastResolve    time.Time
+
+	// mu guards the state below. Apart from the subscribers it is only
+	// written by the watch goroutine, which therefore reads it without
+	// locking.
+	mu sync.Mutex
+	// slices holds the last known state of every EndpointSlice, keyed by
+	// service and slice name.
+	slices map[string]map[string]EndpointSlice
+	// resourceVersion is the version of the last list or watch event seen.
+	// The watch resumes from it after a disconnect; it is cleared whenever
+	// the cache has to be rebuilt with a fresh list.
+	resourceVersion string
+	generation      uint64
+	// synced is set once the slices were listed for the first time.
+	synced bool
+	// subscribers holds the subscribed resolvers keyed by service, refs is
+	// their total number.
+	subscribers map[string]map[*kResolver]struct{}
+	refs        int
+	lastErr     error
+	lastErrTime time.Time
+	// failures is the number of consecutive failures since the last list or
+	// the last established watch.
+	failures     int
+	watching     bool
+	watchStarted time.Time
+	watchStarts  int
+	lastEvent    time.Time
+}
+
+func newInformer(b *Builder, client K8sClient, key informerKey) *informer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	logger := b.logger.With(slog.String("namespace", key.namespace))
+	if key.service != "" {
+		logger = logger.With(slog.String("service", key.service))
+	}
+
+	client = &instrumentedClient{K8sClient: client, metrics: b.metrics, recorder: b.recorders}
+	if b.limiter != nil {
+		// requests waiting for the limiter do not count in their latency
+		client = &limitedClient{K8sClient: client, sem: b.limiter}
+	}
+
+	return &informer{
+		key:       key,
+		k8sClient: client,
+		logger:    logger,
+		metrics:   b.metrics,
+		recorder:  b.recorders,
+
+		ctx:    ctx,
+		cancel: cancel,
+		t:      time.NewTimer(b.resyncPeriod),
+		freq:   b.resyncPeriod,
+
+		watchTimeout:   b.watchTimeout,
+		idleTimeout:    b.idleTimeout(),
+		resolveNow:     make(chan struct{}, 1),
+		resolveNowFreq: b.resolveNowFreq,
+
+		slices:      map[string]map[string]EndpointSlice{},
+		subscribers: map[string]map[*kResolver]struct{}{},
+	}
+}
+
+// start runs the list and watch loop until stop is called.
+func (inf *informer) start(b backoff) {
+	inf.wg.Add(1)
+
+	go func() {
+		defer inf.wg.Done()
+
+		until(func() time.Duration {
+			starts := inf.watchStarts
+
+			err := inf.watch()
+			for errors.Is(err, errResynced) {
+				// the slices were relisted, restart the watch without waiting
+				err = inf.watch()
+			}
+
+			// errors caused by stop are expected
+			if err != nil && err != io.EOF && inf.ctx.Err() == nil {
+				inf.fail(err)
+				inf.log(slog.LevelError, "watching ended with error, will reconnect again",
+					append(errAttrs(err), slog.String("resourceVersion", inf.resourceVersion))...)
+			}
+
+			// only an established watch that was not stalled is healthy, slow
+			// lists and unanswered watches keep backing off
+			if inf.watchStarts == starts || errors.Is(err, errWatchStalled) {
+				return 0
+			}
+
+			return time.Since(inf.watchStarted)
+		}, b, inf.ctx.Done(), inf.logger)
+	}()
+}
+
+// stop ends the watch and waits for the watch goroutine to finish.
+func (inf *informer) stop() {
+	inf.cancel()
+	inf.wg.Wait()
+}
+
+// subscribe adds r to the resolvers receiving the changes. If the slices were
+// already listed, the current state is returned so that r can apply it.
+func (inf *informer) subscribe(r *kResolver) (sliceState, bool) {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+
+	service := r.target.serviceName
+	if inf.subscribers[service] == nil {
+		inf.subscribers[service] = map[*kResolver]struct{}{}
+	}
+
+	inf.subscribers[service][r] = struct{}{}
+	inf.refs++
+
+	return inf.stateLocked(service), inf.synced
+}
+
+// unsubscribe removes r from the resolvers receiving the changes and returns
+// the number of remaining subscribers.
+func (inf *informer) unsubscribe(r *kResolver) int {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+
+	service := r.target.serviceName
+	if _, ok := inf.subscribers[service][r]; !ok {
+		return inf.refs
+	}
+
+	delete(inf.subscribers[service], r)
+	if len(inf.subscribers[service]) == 0 {
+		delete(inf.subscribers, service)
+	}
+
+	inf.refs--
+
+	return inf.refs
+}
+
+// requestResolve asks the watch loop to list the slices again.
+func (inf *informer) requestResolve() {
+	select {
+	case inf.resolveNow <- struct{}{}:
+	default:
+		// a request is already pending
+	}
+}
+
+// targets returns the distinct targets of the resolvers subscribed to the
+// given service, or to any service if it is empty. The watch metrics are
+// reported for each of them.
+func (inf *informer) targets(service string) []string {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+
+	seen := map[string]struct{}{}
+	targets := make([]string, 0, inf.refs)
+
+	for s, subscribers := range inf.subscribers {
+		if service != "" && s != service {
+			continue
+		}
+
+		for r := range subscribers {
+			target := r.target.String()
+			if _, ok := seen[target]; ok {
+				continue
+			}
+
+			seen[target] = struct{}{}
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
+
+// log writes a record with the target attribute of the subscribed resolvers,
+// the logger of the shared informer only carries the namespace and service.
+// Distinct targets, e.g. with different ports, are joined with commas.
+func (inf *informer) log(level slog.Level, msg string, attrs ...any) {
+	if !inf.logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	targets := inf.targets("")
+	sort.Strings(targets)
+
+	attrs = append(attrs, slog.String("target", strings.Join(targets, ",")))
+	inf.logger.Log(context.Background(), level, msg, attrs...)
+}
+
+// serviceOf returns the service owning the given EndpointSlice.
+func (inf *informer) serviceOf(e EndpointSlice) string {
+	if inf.key.service != "" {
+		return inf.key.service
+	}
+
+	return e.Metadata.Labels[serviceNameLabel]
+}
+
+// stateLocked returns the current sliceState of the given service, inf.mu
+// must be held.
+func (inf *informer) stateLocked(service string) sliceState {
+	return sliceState{
+		generation:      inf.generation,
+		resourceVersion: inf.resourceVersion,
+		slices:          inf.slices[service],
+	}
+}
+
+// publish hands the current state of the given service to its subscribers,
+// or of every service to all subscribers if service is empty.
+func (inf *informer) publish(service string) {
+	type delivery struct {
+		r     *kResolver
+		state sliceState
+	}
+
+	inf.mu.Lock()
+	inf.generation++
+
+	deliveries := make([]delivery, 0, inf.refs)
+	for s, subscribers := range inf.subscribers {
+		if service != "" && s != service {
+			continue
+		}
+
+		state := inf.stateLocked(s)
+		for r := range subscribers {
+			deliveries = append(deliveries, delivery{r: r, state: state})
+		}
+	}
+	inf.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.r.apply(d.state)
+	}
+}
+
+// copySlices returns a copy of the slices of the given service to be
+// modified, the published maps are shared with the resolvers and never
+// changed.
+func (inf *informer) copySlices(service string) map[string]EndpointSlice {
+	slices := make(map[string]EndpointSlice, len(inf.slices[service])+1)
+	for name, e := range inf.slices[service] {
+		slices[name] = e
+	}
+
+	return slices
+}
+
+// handle stores the given EndpointSlice in the cache and publishes the
+// resulting state of its service.
+func (inf *informer) handle(e EndpointSlice) {
+	service := inf.serviceOf(e)
+	if service == "" {
+		return
+	}
+
+	slices := inf.copySlices(service)
+	slices[e.Metadata.Name] = e
+
+	inf.mu.Lock()
+	inf.slices[service] = slices
+	inf.mu.Unlock()
+
+	inf.publish(service)
+}
+
+// remove drops the given EndpointSlice from the cache and publishes the
+// remaining state of its service.
+func (inf *informer) remove(e EndpointSlice) {
+	service := inf.serviceOf(e)
+	if _, ok := inf.slices[service][e.Metadata.Name]; !ok {
+		return
+	}
+
+	slices := inf.copySlices(service)
+	delete(slices, e.Metadata.Name)
+
+	inf.mu.Lock()
+	if len(slices) == 0 {
+		delete(inf.slices, service)
+	} else {
+		inf.slices[service] = slices
+	}
+	inf.mu.Unlock()
+
+	inf.publish(service)
+}
+
+// resolve lists all EndpointSlices of the service, replaces the cache with the
+// result and remembers the list's resourceVersion.
+func (inf *informer) resolve() error {
+	// Next lookup should happen after an interval defined by inf.freq.
+	defer inf.t.Reset(inf.freq)
+
+	inf.lastResolve = time.Now()
+
+	ctx, cancel := context.WithTimeout(inf.ctx, listTimeout)
+	defer cancel()
+
+	list, err := getEndpointSliceList(ctx, inf.k8sClient, inf.key.namespace, inf.key.service)
+	if err != nil {
+		return fmt.Errorf("lookup endpoints failed: %w", err)
+	}
+
+	slices := map[string]map[string]EndpointSlice{}
+	for _, e := range list.Items {
+		service := inf.serviceOf(e)
+		if service == "" {
+			continue
+		}
+
+		if slices[service] == nil {
+			slices[service] = map[string]EndpointSlice{}
+		}
+
+		slices[service][e.Metadata.Name] = e
+	}
+
+	inf.mu.Lock()
+	inf.slices = slices
+	inf.resourceVersion = list.Metadata.ResourceVersion
+	inf.synced = true
+	inf.failures = 0
+	inf.mu.Unlock()
+
+	inf.log(slog.LevelDebug, "listed endpoint slices",
+		slog.Int("slices", len(list.Items)),
+		slog.String("resourceVersion", inf.resourceVersion),
+	)
+	inf.publish("")
+
+	return nil
+}
+
+func (inf *informer) watch() error {
+	for _, target := range inf.targets("") {
+		inf.metrics.observeWatchStart(target)
+		inf.recorder.ObserveWatchStart(target)
+	}
+
+	if inf.resourceVersion == "" {
+		// the cache is not in sync with the apiserver, list the current state
+		// and watch for changes that happened after it
+		if err := inf.resolve(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(inf.ctx)
+	defer cancel()
+
+	// the idle timeout covers the wait for the response headers as well, a
+	// watch hanging before them would otherwise never be restarted
+	var headers *time.Timer
+	if inf.idleTimeout > 0 {
+		headers = time.AfterFunc(inf.idleTimeout, cancel)
+	}
+
+	sw, err := watchEndpointSlice(ctx, inf.k8sClient, inf.key.namespace, inf.key.service, inf.resourceVersion, inf.watchTimeout)
+	if headers != nil && !headers.Stop() && inf.ctx.Err() == nil {
+		if err == nil {
+			sw.Stop()
+		}
+
+		return fmt.Errorf("%w: no response received for %s", errWatchStalled, inf.idleTimeout)
+	}
+
+	if err != nil {
+		if IsGone(err) {
+			inf.log(slog.LevelInfo, "resource version expired, will relist", slog.String("resourceVersion", inf.resourceVersion))
+			inf.setResourceVersion("")
+		}
+
+		return err
+	}
+	defer sw.Stop()
+
+	inf.mu.Lock()
+	inf.watching = true
+	inf.watchStarted = time.Now()
+	inf.watchStarts++
+	inf.failures = 0
+	inf.mu.Unlock()
+
+	defer func() {
+		inf.mu.Lock()
+		inf.watching = false
+		inf.mu.Unlock()
+	}()
+
+	inf.log(slog.LevelDebug, "watch started", slog.String("resourceVersion", inf.resourceVersion))
+
+	// idle fires when the watch received nothing for idleTimeout, it is nil
+	// if the check is disabled
+	var (
+		idle      <-chan time.Time
+		idleTimer *time.Timer
+	)
+
+	if inf.idleTimeout > 0 {
+		idleTimer = time.NewTimer(inf.idleTimeout)
+		defer idleTimer.Stop()
+
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-inf.ctx.Done():
+			return nil
+		case <-idle:
+			// the connection may have been dropped without the stream being
+			// closed, events may have been missed so relist
+			inf.setResourceVersion("")
+
+			return fmt.Errorf("%w: no event or bookmark received for %s", errWatchStalled, inf.idleTimeout)
+		case <-inf.t.C:
+			if err := inf.resolve(); err != nil {
+				inf.fail(err)
+				inf.log(slog.LevelError, "resync failed", errAttrs(err)...)
+			} else {
+				// events of this stream may predate the list, watch again from
+				// the listed resourceVersion
+				return errResynced
+			}
+		case <-inf.resolveNow:
+			if wait := inf.resolveNowFreq - time.Since(inf.lastResolve); wait > 0 {
+				// rate limited, let the timer resolve once the interval has passed
+				inf.t.Reset(wait)
+			} else if err := inf.resolve(); err != nil {
+				inf.fail(err)
+				inf.log(slog.LevelError, "resync failed", errAttrs(err)...)
+			} else {
+				return errResynced
+			}
+		case up, hasMore := <-sw.ResultChan():
+			if !hasMore {
+				return sw.Err()
+			}
+
+			inf.mu.Lock()
+			inf.lastEvent = time.Now()
+			inf.mu.Unlock()
+
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					// drain a timer that fired while the event was received
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+
+				idleTimer.Reset(inf.idleTimeout)
+			}
+
+			// object events are counted for the targets of their service,
+			// bookmarks and errors for all targets of the watch
+			service := ""
+			if up.Type != Bookmark && up.Type != Error {
+				service = inf.serviceOf(up.Object)
+			}
+
+			for _, target := range inf.targets(service) {
+				inf.metrics.observeEvent(target, up.Type)
+				inf.recorder.ObserveWatchEvent(target, up.Type)
+			}
+
+			switch up.Type {
+			case Added, Modified:
+				inf.setResourceVersion(up.Object.Metadata.ResourceVersion)
+				inf.handle(up.Object)
+			case Deleted:
+				inf.setResourceVersion(up.Object.Metadata.ResourceVersion)
+				inf.remove(up.Object)
+			case Error:
+				err := &StatusError{Status: *up.Status}
+				if IsGone(err) {
+					// the watch can not be resumed from the resourceVersion,
+					// relist on the next attempt
+					inf.log(slog.LevelInfo, "resource version expired, will relist", slog.String("resourceVersion", inf.resourceVersion))
+					inf.setResourceVersion("")
+				}
+
+				// other failures are retried from the same resourceVersion
+				// after the backoff of until
+				return err
+			case Bookmark:
+				// only advances the resourceVersion
+				inf.setResourceVersion(up.Object.Metadata.ResourceVersion)
+			}
+		}
+	}
+}
+
+func (inf *informer) setResourceVersion(rv string) {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+
+	inf.resourceVersion = rv
+}
+
+// fail records a failed list or watch: it is kept for Snapshot, counted by
+// reason and reported to the subscribers once it persists.
+func (inf *informer) fail(err error) {
+	inf.setError(err)
+	inf.reportError(err)
+
+	reason := failureReason(err)
+	for _, target := range inf.targets("") {
+		inf.metrics.observeWatchFailure(target, reason)
+		inf.recorder.ObserveWatchFailure(target, reason)
+	}
+}
+
+// setError records the error that ended the last watch.
+func (inf *informer) setError(err error) {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+
+	inf.lastErr = err
+	inf.lastErrTime = time.Now()
+	inf.failures++
+}
+
+// reportError hands err to the ClientConns of all subscribers if the slices
+// were never listed, or if the watch failed persistentFailures times in a
+// row. Transient failures of a synced informer are only retried, the
+// resolvers keep their last addresses meanwhile.
+func (inf *informer) reportError(err error) {
+	inf.mu.Lock()
+
+	failures := inf.failures
+	if inf.synced && failures < persistentFailures {
+		inf.mu.Unlock()
+		return
+	}
+
+	resolvers := make([]*kResolver, 0, inf.refs)
+	for _, subscribers := range inf.subscribers {
+		for r := range subscribers {
+			resolvers = append(resolvers, r)
+		}
+	}
+	inf.mu.Unlock()
+
+	for _, r := range resolvers {
+		r.reportError(err, failures)
+	}
+}
@@ -0,0 +1,317 @@
+package kuberesolver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// kubeconfig is the subset of a kubeconfig file used to connect to the
+// apiserver. JSON kubeconfigs are parsed as YAML.
+type kubeconfig struct {
+	Clusters       []namedCluster `yaml:"clusters"`
+	Users          []namedUser    `yaml:"users"`
+	Contexts       []namedContext `yaml:"contexts"`
+	CurrentContext string         `yaml:"current-context"`
+}
+
+type namedCluster struct {
+	Name    string            `yaml:"name"`
+	Cluster kubeconfigCluster `yaml:"cluster"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `yaml:"server"`
+	TLSServerName            string `yaml:"tls-server-name"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+}
+
+type namedUser struct {
+	Name string         `yaml:"name"`
+	User kubeconfigUser `yaml:"user"`
+}
+
+type kubeconfigUser struct {
+	Token                 string      `yaml:"token"`
+	TokenFile             string      `yaml:"tokenFile"`
+	ClientCertificate     string      `yaml:"client-certificate"`
+	ClientCertificateData string      `yaml:"client-certificate-data"`
+	ClientKey             string      `yaml:"client-key"`
+	ClientKeyData         string      `yaml:"client-key-data"`
+	Exec                  *execConfig `yaml:"exec"`
+}
+
+type namedContext struct {
+	Name    string            `yaml:"name"`
+	Context kubeconfigContext `yaml:"context"`
+}
+
+type kubeconfigContext struct {
+	Cluster   string `yaml:"cluster"`
+	User      string `yaml:"user"`
+	Namespace string `yaml:"namespace"`
+}
+
+// NewK8sClientFromKubeconfig creates a K8sClient from the given context of a
+// kubeconfig file, for processes running outside of Kubernetes. If path is
+// empty, the first file of $KUBECONFIG or ~/.kube/config is used. If
+// contextName is empty, the current-context of the file is used. Targets
+// without a namespace resolve in the namespace of the context.
+//
+// Users authenticating with an exec credential plugin run the plugin on the
+// first request; its credentials are then cached until they expire or are
+// rejected by the apiserver.
+func NewK8sClientFromKubeconfig(path, contextName string) (K8sClient, error) {
+	return NewK8sClientFromKubeconfigWithOptions(path, contextName, ClientOptions{})
+}
+
+// NewK8sClientFromKubeconfigWithOptions is NewK8sClientFromKubeconfig with
+// the connections to the apiserver configured by opts.
+func NewK8sClientFromKubeconfigWithOptions(path, contextName string, opts ClientOptions) (K8sClient, error) {
+	if path == "" {
+		var err error
+		if path, err = defaultKubeconfigPath(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse kubeconfig %s: %w", path, err)
+	}
+
+	if contextName == "" {
+		contextName = config.CurrentContext
+	}
+
+	if contextName == "" {
+		return nil, fmt.Errorf("kubeconfig %s has no current-context", path)
+	}
+
+	kctx, cluster, user, err := config.resolve(contextName)
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+	}
+
+	if cluster.Server == "" {
+		return nil, fmt.Errorf("kubeconfig %s: cluster %q has no server", path, kctx.Cluster)
+	}
+
+	// relative paths are relative to the kubeconfig file
+	dir := filepath.Dir(path)
+
+	var closers []io.Closer
+
+	tlsConfig, err := cluster.tlsConfig(dir)
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+	}
+
+	if user.ClientCertificateData == "" && user.ClientKeyData == "" && user.ClientCertificate != "" {
+		// certificates given as files are reloaded when they are rotated
+		reloader, err := newCertReloader(resolvePath(dir, user.ClientCertificate), resolvePath(dir, user.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+		}
+
+		tlsConfig.GetClientCertificate = reloader.clientCertificate
+		closers = append(closers, reloader)
+	} else if tlsConfig.Certificates, err = user.certificates(dir); err != nil {
+		return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+	}
+
+	client := &k8sClient{
+		host:      strings.TrimSuffix(cluster.Server, "/"),
+		namespace: kctx.Namespace,
+		closers:   closers,
+	}
+
+	if user.Exec != nil {
+		ca, err := readData(cluster.CertificateAuthorityData, cluster.CertificateAuthority, dir)
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+		}
+
+		client.exec, err = newExecProvider(*user.Exec, &execCluster{
+			Server:                   cluster.Server,
+			TLSServerName:            cluster.TLSServerName,
+			InsecureSkipTLSVerify:    cluster.InsecureSkipTLSVerify,
+			CertificateAuthorityData: ca,
+		}, dir)
+		if err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+		}
+
+		if len(tlsConfig.Certificates) == 0 && tlsConfig.GetClientCertificate == nil {
+			tlsConfig.GetClientCertificate = client.exec.clientCertificate
+		}
+	}
+
+	if client.httpClient, err = newHTTPClient(tlsConfig, opts); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+	}
+
+	// like kubectl, a token takes precedence over a token file
+	switch {
+	case user.Token != "":
+		client.tokens = NewStaticTokenSource(user.Token)
+	case user.TokenFile != "":
+		if client.tokens, err = NewFileTokenSource(resolvePath(dir, user.TokenFile)); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+
+		client.closers = append(client.closers, client.tokens.(io.Closer))
+	case client.exec != nil:
+		client.tokens = client.exec
+	}
+
+	return client, nil
+}
+
+// defaultKubeconfigPath returns the kubeconfig file used by kubectl.
+func defaultKubeconfigPath() (string, error) {
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			return path, nil
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".kube", "config"), nil
+}
+
+// resolve returns the context with the given name with its cluster and user.
+func (c kubeconfig) resolve(contextName string) (kubeconfigContext, kubeconfigCluster, kubeconfigUser, error) {
+	var (
+		kctx    *kubeconfigContext
+		cluster *kubeconfigCluster
+		user    kubeconfigUser
+	)
+
+	for i := range c.Contexts {
+		if c.Contexts[i].Name == contextName {
+			kctx = &c.Contexts[i].Context
+		}
+	}
+
+	if kctx == nil {
+		return kubeconfigContext{}, kubeconfigCluster{}, kubeconfigUser{}, fmt.Errorf("context %q not found", contextName)
+	}
+
+	for i := range c.Clusters {
+		if c.Clusters[i].Name == kctx.Cluster {
+			cluster = &c.Clusters[i].Cluster
+		}
+	}
+
+	if cluster == nil {
+		return kubeconfigContext{}, kubeconfigCluster{}, kubeconfigUser{}, fmt.Errorf("cluster %q not found", kctx.Cluster)
+	}
+
+	// a context without user connects anonymously
+	if kctx.User != "" {
+		found := false
+
+		for i := range c.Users {
+			if c.Users[i].Name == kctx.User {
+				user, found = c.Users[i].User, true
+			}
+		}
+
+		if !found {
+			return kubeconfigContext{}, kubeconfigCluster{}, kubeconfigUser{}, fmt.Errorf("user %q not found", kctx.User)
+		}
+	}
+
+	return *kctx, *cluster, user, nil
+}
+
+// tlsConfig returns the TLS configuration verifying the apiserver.
+func (c kubeconfigCluster) tlsConfig(dir string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.InsecureSkipTLSVerify, //nolint:gosec // explicitly requested by the kubeconfig
+	}
+
+	ca, err := readData(c.CertificateAuthorityData, c.CertificateAuthority, dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate authority: %w", err)
+	}
+
+	if ca != nil {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in certificate authority")
+		}
+	}
+
+	return config, nil
+}
+
+// certificates returns the client certificate of the user, if any.
+func (u kubeconfigUser) certificates(dir string) ([]tls.Certificate, error) {
+	cert, err := readData(u.ClientCertificateData, u.ClientCertificate, dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client certificate: %w", err)
+	}
+
+	key, err := readData(u.ClientKeyData, u.ClientKey, dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client key: %w", err)
+	}
+
+	if cert == nil && key == nil {
+		return nil, nil
+	}
+
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	return []tls.Certificate{pair}, nil
+}
+
+// readData returns the base64 decoded data if set, or else the content of
+// the file, or nil if neither is set.
+func readData(data, file, dir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if file != "" {
+		return os.ReadFile(resolvePath(dir, file))
+	}
+
+	return nil, nil
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,226 @@
+package kuberesolver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCert returns a PEM encoded self-signed client certificate and key.
+func newTestCert(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// newTestAPIServer starts a TLS server requesting client certificates. It
+// answers with the bearer token and the common name of the client
+// certificate of each request.
+func newTestAPIServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client-Cn", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func caData(srv *httptest.Server) string {
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: srv.Certificate().Raw,
+	}))
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func doTestRequest(t *testing.T, client K8sClient) *http.Response {
+	t.Helper()
+
+	req, err := client.GetRequest(client.Host() + "/api")
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	return resp
+}
+
+func TestKubeconfigToken(t *testing.T) {
+	srv := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	path := writeFile(t, dir, "config", `
+apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: `+srv.URL+`
+    certificate-authority-data: `+caData(srv)+`
+users:
+- name: dev
+  user:
+    token: secret
+- name: ci
+  user:
+    tokenFile: token
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+    namespace: team
+- name: ci
+  context:
+    cluster: dev
+    user: ci
+`)
+	writeFile(t, dir, "token", "from-file\n")
+
+	client, err := NewK8sClientFromKubeconfig(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL, client.Host())
+	assert.Equal(t, "team", client.(*k8sClient).namespace)
+	assert.Equal(t, "Bearer secret", doTestRequest(t, client).Header.Get("X-Authorization"))
+
+	// the token file is relative to the kubeconfig
+	client, err = NewK8sClientFromKubeconfig(path, "ci")
+	require.NoError(t, err)
+	assert.Empty(t, client.(*k8sClient).namespace)
+	assert.Equal(t, "Bearer from-file", doTestRequest(t, client).Header.Get("X-Authorization"))
+
+	_, err = NewK8sClientFromKubeconfig(path, "prod")
+	assert.ErrorContains(t, err, `context "prod" not found`)
+}
+
+func TestKubeconfigClientCertificate(t *testing.T) {
+	srv := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	cert, key := newTestCert(t, "alice")
+	writeFile(t, dir, "ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	writeFile(t, dir, "client.key", string(key))
+
+	// JSON kubeconfigs are supported as well
+	path := writeFile(t, dir, "config.json", `{
+  "apiVersion": "v1",
+  "kind": "Config",
+  "current-context": "dev",
+  "clusters": [{"name": "dev", "cluster": {"server": "`+srv.URL+`", "certificate-authority": "ca.crt"}}],
+  "users": [{"name": "alice", "user": {
+    "client-certificate-data": "`+base64.StdEncoding.EncodeToString(cert)+`",
+    "client-key": "`+filepath.Join(dir, "client.key")+`"
+  }}],
+  "contexts": [{"name": "dev", "context": {"cluster": "dev", "user": "alice"}}]
+}`)
+
+	client, err := NewK8sClientFromKubeconfig(path, "")
+	require.NoError(t, err)
+
+	resp := doTestRequest(t, client)
+	assert.Equal(t, "alice", resp.Header.Get("X-Client-Cn"))
+	assert.Empty(t, resp.Header.Get("X-Authorization"))
+}
+
+func TestKubeconfigClientClose(t *testing.T) {
+	srv := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	cert, key := newTestCert(t, "alice")
+	writeFile(t, dir, "client.crt", string(cert))
+	writeFile(t, dir, "client.key", string(key))
+	writeFile(t, dir, "token", "from-file")
+
+	path := writeFile(t, dir, "config", `
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: `+srv.URL+`
+    certificate-authority-data: `+caData(srv)+`
+users:
+- name: dev
+  user:
+    tokenFile: token
+    client-certificate: client.crt
+    client-key: client.key
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+`)
+
+	before := runtime.NumGoroutine()
+
+	client, err := NewK8sClientFromKubeconfig(path, "")
+	require.NoError(t, err)
+
+	resp := doTestRequest(t, client)
+	assert.Equal(t, "alice", resp.Header.Get("X-Client-Cn"))
+	assert.Equal(t, "Bearer from-file", resp.Header.Get("X-Authorization"))
+
+	// the token and certificate watchers and the idle connection are released,
+	// polled by hand since assert.Eventually runs its own goroutines
+	require.NoError(t, client.(io.Closer).Close())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
+}
@@ -5,14 +5,15 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -23,6 +24,9 @@ const (
 	serviceAccountCACert    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
 	kubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 	defaultNamespace        = "default"
+	// serviceNameLabel is set on an EndpointSlice to the name of the service
+	// owning it.
+	serviceNameLabel = "kubernetes.io/service-name"
 )
 
 // K8sClient is minimal kubernetes client interface
@@ -33,10 +37,18 @@ type K8sClient interface {
 }
 
 type k8sClient struct {
-	host       string
-	token      string
-	tokenLck   sync.RWMutex
+	host string
+	// namespace is the default namespace of targets without one, empty to
+	// use the namespace of the pod.
+	namespace string
+	// tokens provides the bearer token of each request, nil to send none.
+	tokens TokenSource
+	// exec is set if the credentials come from an exec plugin, which is
+	// asked for new ones when the apiserver rejects them.
+	exec       *execProvider
 	httpClient *http.Client
+	// closers are the file watchers owned by the client.
+	closers []io.Closer
 }
 
 func (kc *k8sClient) GetRequest(url string) (*http.Request, error) {
@@ -49,63 +61,96 @@ func (kc *k8sClient) GetRequest(url string) (*http.Request, error) {
 		return nil, err
 	}
 
-	kc.tokenLck.RLock()
-	defer kc.tokenLck.RUnlock()
+	if kc.tokens != nil {
+		token, err := kc.tokens.Token()
+		if err != nil {
+			return nil, err
+		}
 
-	if len(kc.token) > 0 {
-		req.Header.Set("Authorization", "Bearer "+kc.token)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
 	}
 
 	return req, nil
 }
 
 func (kc *k8sClient) Do(req *http.Request) (*http.Response, error) {
-	return kc.httpClient.Do(req)
+	resp, err := kc.httpClient.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && kc.exec != nil {
+		// the credentials were revoked before they expired, get new ones
+		// for the next request
+		kc.exec.invalidate()
+	}
+
+	return resp, err
 }
 
 func (kc *k8sClient) Host() string {
 	return kc.host
 }
 
-func (kc *k8sClient) setToken(token string) {
-	kc.tokenLck.Lock()
-	defer kc.tokenLck.Unlock()
+// Close stops watching the token and certificate files of the client and
+// closes its idle connections. It implements io.Closer, the client must not
+// be used after Close.
+func (kc *k8sClient) Close() error {
+	errs := make([]error, 0, len(kc.closers))
+	for _, c := range kc.closers {
+		errs = append(errs, c.Close())
+	}
 
-	kc.token = token
+	// the default client is shared with the rest of the process
+	if kc.httpClient != nil && kc.httpClient != http.DefaultClient {
+		kc.httpClient.CloseIdleConnections()
+	}
+
+	return errors.Join(errs...)
 }
 
-// NewInClusterK8sClient creates K8sClient if it is inside Kubernetes
+// NewInClusterK8sClient creates K8sClient if it is inside Kubernetes. The
+// returned client implements io.Closer to stop watching the service account
+// token.
 func NewInClusterK8sClient() (K8sClient, error) {
+	return NewInClusterK8sClientWithOptions(ClientOptions{})
+}
+
+// NewInClusterK8sClientWithOptions is NewInClusterK8sClient with the
+// connections to the apiserver configured by opts.
+func NewInClusterK8sClientWithOptions(opts ClientOptions) (K8sClient, error) {
 	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
 	if len(host) == 0 || len(port) == 0 {
 		return nil, fmt.Errorf("unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be defined")
 	}
 
-	token, err := os.ReadFile(serviceAccountToken)
+	tlsConfig, err := newTLSConfig(serviceAccountCACert)
 	if err != nil {
 		return nil, err
 	}
 
-	ca, err := os.ReadFile(serviceAccountCACert)
+	httpClient, err := newHTTPClient(tlsConfig, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(ca)
-	transport := &http.Transport{TLSClientConfig: &tls.Config{
-		MinVersion: tls.VersionTLS10,
-		RootCAs:    certPool,
-	}}
-	httpClient := &http.Client{Transport: transport, Timeout: time.Nanosecond * 0}
+	tokens, err := NewFileTokenSource(serviceAccountToken)
+	if err != nil {
+		return nil, err
+	}
 
 	client := &k8sClient{
 		host:       "https://" + net.JoinHostPort(host, port),
-		token:      string(token),
+		tokens:     tokens,
 		httpClient: httpClient,
+		closers:    []io.Closer{tokens.(io.Closer)},
 	}
 
+	return client, nil
+}
+
+// watchFiles calls onChange whenever one of the files changes.
+func watchFiles(onChange func(), paths ...string) (*fsnotify.Watcher, error) {
 	// Create a new file watcher to listen for new Service Account tokens
+	// or certificates
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
@@ -124,19 +169,13 @@ func NewInClusterK8sClient() (K8sClient, error) {
 					// remove watcher since the file is removed
 					_ = watcher.Remove(event.Name)
 					// add a new watcher pointing to the new symlink/file
-					_ = watcher.Add(serviceAccountToken)
+					_ = watcher.Add(event.Name)
 
-					token, err := os.ReadFile(serviceAccountToken)
-					if err == nil {
-						client.setToken(string(token))
-					}
+					onChange()
 				}
 
 				if event.Has(fsnotify.Write) {
-					token, err := os.ReadFile(serviceAccountToken)
-					if err == nil {
-						client.setToken(string(token))
-					}
+					onChange()
 				}
 			case _, ok := <-watcher.Errors:
 				if !ok {
@@ -146,12 +185,72 @@ func NewInClusterK8sClient() (K8sClient, error) {
 		}
 	}()
 
-	err = watcher.Add(serviceAccountToken)
+	for _, path := range paths {
+		if err := watcher.Add(path); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+	}
+
+	return watcher, nil
+}
+
+// NewK8sClientWithTokenSource creates a K8sClient authenticating to the
+// apiserver at apiURL with the tokens of ts. If caFile is empty the system
+// roots verify the apiserver.
+func NewK8sClientWithTokenSource(apiURL, caFile string, ts TokenSource) (K8sClient, error) {
+	return NewK8sClientWithTokenSourceWithOptions(apiURL, caFile, ts, ClientOptions{})
+}
+
+// NewK8sClientWithTokenSourceWithOptions is NewK8sClientWithTokenSource with
+// the connections to the apiserver configured by opts.
+func NewK8sClientWithTokenSourceWithOptions(apiURL, caFile string, ts TokenSource, opts ClientOptions) (K8sClient, error) {
+	tlsConfig, err := newTLSConfig(caFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return client, nil
+	httpClient, err := newHTTPClient(tlsConfig, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k8sClient{
+		host:       strings.TrimSuffix(apiURL, "/"),
+		tokens:     ts,
+		httpClient: httpClient,
+	}, nil
+}
+
+// newTLSConfig returns the TLS configuration verifying the apiserver with the
+// certificates of caFile, or the system roots if it is empty.
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// newHTTPClient returns the client connecting to the apiserver with
+// tlsConfig and opts.
+func newHTTPClient(tlsConfig *tls.Config, opts ClientOptions) (*http.Client, error) {
+	transport, err := opts.transport(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: transport}, nil
 }
 
 // NewInsecureK8sClient creates an insecure k8s client which is suitable
@@ -163,18 +262,56 @@ func NewInsecureK8sClient(apiURL string) K8sClient {
 	}
 }
 
-func getEndpointSliceList(client K8sClient, namespace, targetName string) (EndpointSliceList, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=kubernetes.io/service-name=%s",
-		client.Host(), namespace, targetName))
+// NewInsecureK8sClientWithOptions is NewInsecureK8sClient with its own
+// transport configured by opts instead of http.DefaultClient.
+func NewInsecureK8sClientWithOptions(apiURL string, opts ClientOptions) (K8sClient, error) {
+	httpClient, err := newHTTPClient(&tls.Config{MinVersion: tls.VersionTLS12}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k8sClient{
+		host:       apiURL,
+		httpClient: httpClient,
+	}, nil
+}
+
+func endpointSliceURL(client K8sClient, watch bool, namespace, targetName string, query url.Values) (string, error) {
+	path := "/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices"
+	if watch {
+		path = "/apis/discovery.k8s.io/v1/watch/namespaces/%s/endpointslices"
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s"+path, client.Host(), namespace))
+	if err != nil {
+		return "", err
+	}
+
+	if targetName == "" {
+		// every slice owned by a service
+		query.Set("labelSelector", serviceNameLabel)
+	} else {
+		query.Set("labelSelector", serviceNameLabel+"="+targetName)
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func getEndpointSliceList(ctx context.Context, client K8sClient, namespace, targetName string) (EndpointSliceList, error) {
+	u, err := endpointSliceURL(client, false, namespace, targetName, url.Values{})
 	if err != nil {
 		return EndpointSliceList{}, err
 	}
 
-	req, err := client.GetRequest(u.String())
+	req, err := client.GetRequest(u)
 	if err != nil {
 		return EndpointSliceList{}, err
 	}
 
+	req = req.WithContext(ctx)
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return EndpointSliceList{}, err
@@ -184,7 +321,7 @@ func getEndpointSliceList(client K8sClient, namespace, targetName string) (Endpo
 	}(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return EndpointSliceList{}, fmt.Errorf("invalid response code %d for service %s in namespace %s", resp.StatusCode, targetName, namespace)
+		return EndpointSliceList{}, newAPIError(resp, namespace, targetName)
 	}
 
 	result := EndpointSliceList{}
@@ -193,14 +330,28 @@ func getEndpointSliceList(client K8sClient, namespace, targetName string) (Endpo
 	return result, err
 }
 
-func watchEndpointSlice(ctx context.Context, client K8sClient, namespace, targetName string) (watchInterface, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/apis/discovery.k8s.io/v1/watch/namespaces/%s/endpointslices?labelSelector=kubernetes.io/service-name=%s",
-		client.Host(), namespace, targetName))
+// watchEndpointSlice starts watching the EndpointSlices of the service. If
+// resourceVersion is not empty the watch resumes right after it, otherwise the
+// apiserver starts with synthetic ADDED events for the current state. A
+// positive timeout asks the apiserver to end the watch after that duration.
+func watchEndpointSlice(ctx context.Context, client K8sClient, namespace, targetName, resourceVersion string, timeout time.Duration) (watchInterface, error) {
+	query := url.Values{}
+	query.Set("allowWatchBookmarks", "true")
+
+	if timeout > 0 {
+		query.Set("timeoutSeconds", strconv.FormatInt(int64(timeout/time.Second), 10))
+	}
+
+	if resourceVersion != "" {
+		query.Set("resourceVersion", resourceVersion)
+	}
+
+	u, err := endpointSliceURL(client, true, namespace, targetName, query)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := client.GetRequest(u.String())
+	req, err := client.GetRequest(u)
 	if err != nil {
 		return nil, err
 	}
@@ -217,7 +368,8 @@ func watchEndpointSlice(ctx context.Context, client K8sClient, namespace, target
 			_ = Body.Close()
 		}(resp.Body)
 
-		return nil, fmt.Errorf("invalid response code %d for service %s in namespace %s", resp.StatusCode, targetName, namespace)
+		// a 410 Gone means that the resourceVersion expired
+		return nil, newAPIError(resp, namespace, targetName)
 	}
 
 	return newStreamWatcher(resp.Body), nil
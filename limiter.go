@@ -0,0 +1,50 @@
+package kuberesolver
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// limitedClient bounds the number of list and watch requests of the wrapped
+// client in flight. A list holds its slot until its body is closed, a watch
+// until the apiserver answered with the headers, so that streaming watch
+// bodies do not hold one.
+type limitedClient struct {
+	K8sClient
+	sem chan struct{}
+}
+
+func (c *limitedClient) Do(req *http.Request) (*http.Response, error) {
+	select {
+	case c.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	var once sync.Once
+
+	release := func() { once.Do(func() { <-c.sem }) }
+
+	resp, err := c.K8sClient.Do(req)
+	if err != nil || requestVerb(req) == verbWatch {
+		release()
+		return resp, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+
+	return resp, nil
+}
+
+// releasingBody releases the slot of a list once its body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+
+	return b.ReadCloser.Close()
+}
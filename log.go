@@ -0,0 +1,113 @@
+package kuberesolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+// grpclogHandler is a slog.Handler writing to grpclog, it is the default
+// logger of the builder so that the output ends up where it always did.
+// Attributes are appended to the message as key=value pairs.
+type grpclogHandler struct {
+	// attrs holds the preformatted attributes added with WithAttrs.
+	attrs string
+	// group is the prefix of the keys added after a WithGroup call.
+	group string
+}
+
+func newGrpclogLogger() *slog.Logger {
+	return slog.New(&grpclogHandler{})
+}
+
+func (h *grpclogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if level < slog.LevelInfo {
+		return grpclog.V(2)
+	}
+
+	return true
+}
+
+func (h *grpclogHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+
+	sb.WriteString("kuberesolver: ")
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&sb, h.group, a)
+		return true
+	})
+
+	// report the caller of the slog.Logger method instead of slog itself
+	const depth = 3
+
+	switch {
+	case r.Level >= slog.LevelError:
+		grpclog.ErrorDepth(depth, sb.String())
+	case r.Level >= slog.LevelWarn:
+		grpclog.WarningDepth(depth, sb.String())
+	default:
+		grpclog.InfoDepth(depth, sb.String())
+	}
+
+	return nil
+}
+
+func (h *grpclogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+
+	sb.WriteString(h.attrs)
+
+	for _, a := range attrs {
+		appendAttr(&sb, h.group, a)
+	}
+
+	return &grpclogHandler{attrs: sb.String(), group: h.group}
+}
+
+func (h *grpclogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return &grpclogHandler{attrs: h.attrs, group: h.group + name + "."}
+}
+
+// appendAttr writes a as key=value, flattening groups into dotted keys.
+func appendAttr(sb *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+
+		for _, ga := range a.Value.Group() {
+			appendAttr(sb, prefix, ga)
+		}
+
+		return
+	}
+
+	fmt.Fprintf(sb, " %s%s=%v", prefix, a.Key, a.Value)
+}
+
+// errAttrs returns the log attributes of err, including the details reported
+// by the apiserver if there are any.
+func errAttrs(err error) []any {
+	attrs := []any{slog.Any("err", err)}
+
+	if code, reason, ok := statusOf(err); ok {
+		attrs = append(attrs, slog.Int("status", code), slog.String("reason", string(reason)))
+	}
+
+	return attrs
+}
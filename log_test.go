@@ -0,0 +1,98 @@
+package kuberesolver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/resolver"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestLoggerHasTargetContext(t *testing.T) {
+	srv := newMockKubeServer(t)
+	defer srv.Close()
+
+	var buf syncBuffer
+
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	bl := NewBuilderWithOptions(NewInsecureK8sClient(srv.URL), kubernetesSchema,
+		WithLogger(logger),
+		WithRegisterer(prometheus.NewRegistry()),
+	)
+	fc := &fakeConn{
+		cmp: make(chan struct{}, 1),
+	}
+
+	rs, err := bl.Build(parseTarget("kubernetes:///kube-dns.kube-system:53"), fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-fc.cmp
+	rs.Close()
+
+	var update, listed map[string]any
+
+	sc := bufio.NewScanner(strings.NewReader(buf.String()))
+	for sc.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+
+		switch record["msg"] {
+		case "updated addresses":
+			update = record
+		case "listed endpoint slices":
+			listed = record
+		}
+	}
+
+	// records of the shared informer carry the targets of its resolvers
+	if assert.NotNil(t, listed, "no debug log for the list") {
+		assert.Equal(t, "kubernetes://kube-system/kube-dns:53", listed["target"])
+		assert.Equal(t, "kube-dns", listed["service"])
+	}
+
+	if assert.NotNil(t, update, "no debug log for the address update") {
+		assert.Equal(t, "kubernetes://kube-system/kube-dns:53", update["target"])
+		assert.Equal(t, "kube-system", update["namespace"])
+		assert.Equal(t, "kube-dns", update["service"])
+		assert.Equal(t, []any{"10.0.0.1:53", "10.0.0.2:53"}, update["addresses"])
+	}
+}
+
+func TestAppendAttr(t *testing.T) {
+	var sb strings.Builder
+
+	appendAttr(&sb, "", slog.String("target", "kubernetes://ns/svc:80"))
+	appendAttr(&sb, "", slog.Group("status", slog.Int("code", 410), slog.String("reason", "Expired")))
+	appendAttr(&sb, "watch.", slog.String("resourceVersion", "42"))
+
+	assert.Equal(t, " target=kubernetes://ns/svc:80 status.code=410 status.reason=Expired watch.resourceVersion=42", sb.String())
+}
@@ -0,0 +1,308 @@
+package kuberesolver
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	verbList  = "list"
+	verbWatch = "watch"
+)
+
+// metrics holds the collectors of a builder.
+type metrics struct {
+	endpointsForTarget *prometheus.GaugeVec
+	addressesForTarget *prometheus.GaugeVec
+	clientLastUpdate   *prometheus.GaugeVec
+	watchStarts        *prometheus.CounterVec
+	watchFailures      *prometheus.CounterVec
+	watchEvents        *prometheus.CounterVec
+	requestDuration    *prometheus.HistogramVec
+	requests           *prometheus.CounterVec
+	targets            *targetState
+}
+
+// targetState holds the reference counts and the last watch event of the
+// targets, and exports the seconds since that event at collection time. It
+// is registered like the collectors, so that builders using the same
+// registerer get it back from the registry and share it; it is not kept
+// once the registry is gone.
+type targetState struct {
+	mu sync.Mutex
+	// refs counts the open resolvers of each target, the series of a target
+	// are deleted when its last resolver is closed.
+	refs map[string]int
+	// lastEvent is the time of the last watch event of each target.
+	lastEvent map[string]time.Time
+}
+
+// metricsFor returns the metrics registered to reg. Collectors already
+// registered by another builder are shared with it.
+func metricsFor(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		endpointsForTarget: register(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kuberesolver_endpoints_total",
+				Help: "The number of endpoints for a given target",
+			},
+			[]string{"target"},
+		)),
+		addressesForTarget: register(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kuberesolver_addresses_total",
+				Help: "The number of addresses for a given target",
+			},
+			[]string{"target"},
+		)),
+		clientLastUpdate: register(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "kuberesolver_client_last_update",
+				Help: "The last time the resolver client was updated",
+			},
+			[]string{"target"},
+		)),
+		watchStarts: register(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kuberesolver_watch_starts_total",
+				Help: "The number of times the watch of a given target was started",
+			},
+			[]string{"target"},
+		)),
+		watchFailures: register(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kuberesolver_watch_failures_total",
+				Help: "The number of times the list or watch of a given target failed, by reason",
+			},
+			[]string{"target", "reason"},
+		)),
+		watchEvents: register(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kuberesolver_watch_events_total",
+				Help: "The number of watch events received for a given target, by event type",
+			},
+			[]string{"target", "type"},
+		)),
+		requestDuration: register(reg, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kuberesolver_api_request_duration_seconds",
+				Help:    "The latency of list and watch requests to the kubernetes api",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"verb"},
+		)),
+		requests: register(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kuberesolver_api_requests_total",
+				Help: "The number of list and watch requests to the kubernetes api, by response code",
+			},
+			[]string{"verb", "code"},
+		)),
+		targets: register(reg, &targetState{
+			refs:      map[string]int{},
+			lastEvent: map[string]time.Time{},
+		}),
+	}
+}
+
+// register registers c to reg. If an identical collector is already
+// registered, e.g. by another copy of this module, that one is returned
+// instead. Registration failures never panic; the collector then still works
+// but is not exported.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+
+	return c
+}
+
+// acquire marks target as used by one more resolver.
+func (m *metrics) acquire(target string) {
+	m.targets.mu.Lock()
+	defer m.targets.mu.Unlock()
+
+	m.targets.refs[target]++
+}
+
+// release marks target as no longer used by a resolver and deletes its
+// series once no resolver uses it.
+func (m *metrics) release(target string) {
+	m.targets.mu.Lock()
+	defer m.targets.mu.Unlock()
+
+	m.targets.refs[target]--
+	if m.targets.refs[target] > 0 {
+		return
+	}
+
+	delete(m.targets.refs, target)
+	delete(m.targets.lastEvent, target)
+
+	labels := prometheus.Labels{"target": target}
+	m.endpointsForTarget.DeletePartialMatch(labels)
+	m.addressesForTarget.DeletePartialMatch(labels)
+	m.clientLastUpdate.DeletePartialMatch(labels)
+	m.watchStarts.DeletePartialMatch(labels)
+	m.watchFailures.DeletePartialMatch(labels)
+	m.watchEvents.DeletePartialMatch(labels)
+}
+
+// observeWatchStart counts a watch start of target. Like the other watch
+// observations it is dropped once the last resolver of target is closed, the
+// increment would create the deleted series again.
+func (m *metrics) observeWatchStart(target string) {
+	m.targets.mu.Lock()
+	defer m.targets.mu.Unlock()
+
+	if _, ok := m.targets.refs[target]; ok {
+		m.watchStarts.WithLabelValues(target).Inc()
+	}
+}
+
+// observeWatchFailure counts a watch failure of target.
+func (m *metrics) observeWatchFailure(target, reason string) {
+	m.targets.mu.Lock()
+	defer m.targets.mu.Unlock()
+
+	if _, ok := m.targets.refs[target]; ok {
+		m.watchFailures.WithLabelValues(target, reason).Inc()
+	}
+}
+
+// observeEvent counts a watch event of target.
+func (m *metrics) observeEvent(target string, t EventType) {
+	m.targets.mu.Lock()
+	defer m.targets.mu.Unlock()
+
+	if _, ok := m.targets.refs[target]; ok {
+		m.watchEvents.WithLabelValues(target, string(t)).Inc()
+		m.targets.lastEvent[target] = time.Now()
+	}
+}
+
+// observeRequest records the latency and the response code of a request to
+// the kubernetes api. A zero code means the request failed without response.
+func (m *metrics) observeRequest(verb string, code int, d time.Duration) {
+	m.requestDuration.WithLabelValues(verb).Observe(d.Seconds())
+
+	c := "error"
+	if code != 0 {
+		c = strconv.Itoa(code)
+	}
+
+	m.requests.WithLabelValues(verb, c).Inc()
+}
+
+var sinceLastEventDesc = prometheus.NewDesc(
+	"kuberesolver_seconds_since_last_watch_event",
+	"The number of seconds since the last watch event or bookmark of a given target",
+	[]string{"target"}, nil,
+)
+
+func (s *targetState) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sinceLastEventDesc
+}
+
+func (s *targetState) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for target, t := range s.lastEvent {
+		ch <- prometheus.MustNewConstMetric(sinceLastEventDesc, prometheus.GaugeValue, time.Since(t).Seconds(), target)
+	}
+}
+
+// instrumentedClient records the metrics of every request done with the
+// wrapped client.
+type instrumentedClient struct {
+	K8sClient
+	metrics  *metrics
+	recorder MetricsRecorder
+}
+
+// requestVerb returns the verb label of a request to the apiserver.
+func requestVerb(req *http.Request) string {
+	if strings.Contains(req.URL.Path, "/watch/") || req.URL.Query().Get("watch") == "true" {
+		return verbWatch
+	}
+
+	return verbList
+}
+
+func (c *instrumentedClient) Do(req *http.Request) (*http.Response, error) {
+	verb := requestVerb(req)
+
+	start := time.Now()
+	resp, err := c.K8sClient.Do(req)
+
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+	}
+
+	d := time.Since(start)
+	c.metrics.observeRequest(verb, code, d)
+	c.recorder.ObserveRequest(verb, code, d)
+
+	return resp, err
+}
+
+// failureReason returns the reason label of a list or watch failure. Status
+// reasons are converted to the same snake_case vocabulary as the other
+// labels, e.g. NotFound to not_found.
+func failureReason(err error) string {
+	var ue *url.Error
+
+	_, reason, _ := statusOf(err)
+
+	switch {
+	case IsGone(err):
+		return "expired"
+	case errors.Is(err, errWatchStalled):
+		return "stalled"
+	case reason == StatusReasonInternal:
+		return "internal"
+	case reason != "":
+		return snakeCase(string(reason))
+	case errors.As(err, &ue):
+		return "connection"
+	default:
+		return "unknown"
+	}
+}
+
+// snakeCase converts a CamelCase status reason to snake_case.
+func snakeCase(s string) string {
+	var b strings.Builder
+
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+
+			r = unicode.ToLower(r)
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
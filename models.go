@@ -1,5 +1,7 @@
 package kuberesolver
 
+import "encoding/json"
+
 type EventType string
 
 const (
@@ -7,26 +9,58 @@ const (
 	Modified EventType = "MODIFIED"
 	Deleted  EventType = "DELETED"
 	Error    EventType = "ERROR"
+	// Bookmark events only carry the resourceVersion the watch has reached,
+	// they are sent when the watch is started with allowWatchBookmarks=true.
+	Bookmark EventType = "BOOKMARK"
 )
 
 // Event represents a single event to a watched resource.
 type Event struct {
 	Type   EventType     `json:"type"`
 	Object EndpointSlice `json:"object"`
+	// Raw is the object of the event as it was received from the apiserver.
+	Raw json.RawMessage `json:"-"`
+	// Status is the decoded object of an ERROR event.
+	Status *Status `json:"-"`
+}
+
+// Status is returned by the apiserver to describe a failed request or a
+// failed watch.
+type Status struct {
+	Status  string       `json:"status"`
+	Message string       `json:"message"`
+	Reason  StatusReason `json:"reason"`
+	Code    int          `json:"code"`
 }
 
+// StatusReason is a machine readable description of why a request failed.
+type StatusReason string
+
+const (
+	StatusReasonExpired      StatusReason = "Expired"
+	StatusReasonGone         StatusReason = "Gone"
+	StatusReasonForbidden    StatusReason = "Forbidden"
+	StatusReasonUnauthorized StatusReason = "Unauthorized"
+	StatusReasonNotFound     StatusReason = "NotFound"
+	StatusReasonInternal     StatusReason = "InternalError"
+)
+
 type EndpointSliceList struct {
-	Items []EndpointSlice
+	Metadata ListMetadata    `json:"metadata"`
+	Items    []EndpointSlice `json:"items"`
 }
 
 type EndpointSlice struct {
-	Endpoints []Endpoint
-	Ports     []EndpointPort
+	Metadata  Metadata       `json:"metadata"`
+	Endpoints []Endpoint     `json:"endpoints"`
+	Ports     []EndpointPort `json:"ports"`
 }
 
 type Endpoint struct {
-	Addresses  []string
-	Conditions EndpointConditions
+	Addresses  []string           `json:"addresses"`
+	Conditions EndpointConditions `json:"conditions"`
+	NodeName   *string            `json:"nodeName"`
+	Zone       *string            `json:"zone"`
 }
 
 type EndpointConditions struct {
@@ -41,6 +75,11 @@ type Metadata struct {
 	ResourceVersion string            `json:"resourceVersion"`
 	Labels          map[string]string `json:"labels"`
 }
+
+type ListMetadata struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
 type EndpointPort struct {
 	Name string `json:"name"`
 	Port int    `json:"port"`
@@ -0,0 +1,162 @@
+package kuberesolver
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures a builder created by NewBuilderWithOptions.
+type Option func(*Builder)
+
+// EndpointFilter reports whether the addresses of a ready endpoint should be
+// handed to gRPC.
+type EndpointFilter func(e Endpoint) bool
+
+// WithResyncPeriod sets the interval at which the EndpointSlices are listed
+// again even if the watch did not report any change. Non-positive durations
+// are ignored. Default is 30 minutes.
+func WithResyncPeriod(d time.Duration) Option {
+	return func(b *Builder) {
+		if d > 0 {
+			b.resyncPeriod = d
+		}
+	}
+}
+
+// WithBackoff sets the bounds of the delay between two attempts to restart
+// a failed watch. The delay doubles with each failure up to maxDelay, which
+// is raised to initial if it is lower. A non-positive initial delay is
+// ignored. Default is 1 second up to 30 seconds.
+func WithBackoff(initial, maxDelay time.Duration) Option {
+	return func(b *Builder) {
+		if initial <= 0 {
+			return
+		}
+
+		b.backoff.initial = initial
+		b.backoff.max = max(maxDelay, initial)
+	}
+}
+
+// WithBackoffJitter sets the randomized fraction of the backoff delay, so
+// that resolvers do not reconnect in lockstep: each delay is reduced by a
+// random duration of up to factor times the delay. Default is 1, full
+// jitter, and 0 disables jitter.
+func WithBackoffJitter(factor float64) Option {
+	return func(b *Builder) {
+		b.backoff.jitter = factor
+	}
+}
+
+// WithBackoffReset sets how long a watch has to run before it is considered
+// healthy and the backoff delay is reset to its initial value. Non-positive
+// durations are ignored. Default is 1 minute.
+func WithBackoffReset(d time.Duration) Option {
+	return func(b *Builder) {
+		if d > 0 {
+			b.backoff.healthy = d
+		}
+	}
+}
+
+// WithMaxConcurrentRequests limits the list and watch requests of all
+// resolvers of the builder in flight to n, which protects the apiserver when
+// many resolvers reconnect at once. A list counts until its response was
+// read, at most 1 minute; a watch until the apiserver answered, at most the
+// watch idle timeout. Established watches do not count against the limit,
+// but with the watch idle timeout disabled a watch left unanswered keeps
+// its slot until the resolver is closed. Default is no limit.
+func WithMaxConcurrentRequests(n int) Option {
+	return func(b *Builder) {
+		if n > 0 {
+			b.limiter = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithWatchTimeout sets the duration after which the apiserver closes a
+// watch; it is resumed right after. Default is 5 minutes.
+func WithWatchTimeout(d time.Duration) Option {
+	return func(b *Builder) {
+		b.watchTimeout = d
+	}
+}
+
+// WithWatchIdleTimeout sets the duration after which a watch that received
+// neither events nor bookmarks is considered dead, e.g. because the
+// connection was silently dropped by a NAT or load balancer. The watch is
+// then torn down and the EndpointSlices are listed again. A negative
+// duration disables the check. Default is the watch timeout plus one
+// minute, or disabled if the watch has no timeout.
+func WithWatchIdleTimeout(d time.Duration) Option {
+	return func(b *Builder) {
+		b.watchIdleTimeout = d
+	}
+}
+
+// WithResolveNowInterval sets the minimum interval between two lists
+// triggered by gRPC calling ResolveNow. Default is 5 seconds.
+func WithResolveNowInterval(d time.Duration) Option {
+	return func(b *Builder) {
+		b.resolveNowFreq = d
+	}
+}
+
+// WithNamespaceWatch makes the builder watch all EndpointSlices of a
+// namespace with a single watch and dispatch them to the resolvers by their
+// kubernetes.io/service-name label, instead of watching each service. This
+// keeps one apiserver connection per namespace at the cost of caching the
+// slices of services no resolver uses.
+func WithNamespaceWatch() Option {
+	return func(b *Builder) {
+		b.namespaceWatch = true
+	}
+}
+
+// WithLogger sets the logger of the builder and its resolvers. By default
+// logs are written to grpclog. A nil logger is ignored.
+func WithLogger(logger *slog.Logger) Option {
+	return func(b *Builder) {
+		if logger != nil {
+			b.logger = logger
+		}
+	}
+}
+
+// WithRegisterer registers the metrics of the builder to reg instead of
+// prometheus.DefaultRegisterer. Builders given the same registerer share
+// their collectors. A nil registerer is ignored.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(b *Builder) {
+		if reg != nil {
+			b.metrics = metricsFor(reg)
+		}
+	}
+}
+
+// WithEndpointFilter adds a filter for the ready endpoints of a service. An
+// endpoint is used only if all filters accept it.
+func WithEndpointFilter(f EndpointFilter) Option {
+	return func(b *Builder) {
+		b.filters = append(b.filters, f)
+	}
+}
+
+// WithMetricsRecorder adds a recorder that receives the measurements of the
+// resolvers in addition to the Prometheus metrics.
+func WithMetricsRecorder(r MetricsRecorder) Option {
+	return func(b *Builder) {
+		b.recorders = append(b.recorders, r)
+	}
+}
+
+// WithClientWrapper wraps the K8sClient used by the resolvers, e.g. to trace
+// or to authorize the requests to the kubernetes api. Wrappers are applied in
+// the order they are given, the last one is the outermost.
+func WithClientWrapper(wrap func(K8sClient) K8sClient) Option {
+	return func(b *Builder) {
+		b.clientWrappers = append(b.clientWrappers, wrap)
+	}
+}
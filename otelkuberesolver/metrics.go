@@ -0,0 +1,209 @@
+package otelkuberesolver
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sercand/kuberesolver/v6"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// WithMetrics returns a builder option that records the resolver metrics
+// with OpenTelemetry instruments. Errors creating the instruments are
+// reported to the global OpenTelemetry error handler.
+func WithMetrics(opts ...Option) kuberesolver.Option {
+	c := newConfig(opts)
+
+	r, err := newRecorder(c.meterProvider.Meter(ScopeName))
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	return kuberesolver.WithMetricsRecorder(r)
+}
+
+// targetState is the last known state of a target, reported by the
+// observable gauges.
+type targetState struct {
+	refs       int
+	endpoints  int64
+	addresses  int64
+	lastUpdate time.Time
+	lastEvent  time.Time
+}
+
+type recorder struct {
+	watchStarts     metric.Int64Counter
+	watchFailures   metric.Int64Counter
+	watchEvents     metric.Int64Counter
+	requests        metric.Int64Counter
+	requestDuration metric.Float64Histogram
+
+	mu      sync.Mutex
+	targets map[string]*targetState
+}
+
+// newRecorder creates the instruments of the recorder. The first error is
+// returned together with the recorder, like the meter does for instruments.
+func newRecorder(meter metric.Meter) (*recorder, error) {
+	r := &recorder{targets: map[string]*targetState{}}
+
+	var err error
+
+	record := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+
+	var e error
+
+	r.watchStarts, e = meter.Int64Counter("kuberesolver.watch.starts",
+		metric.WithDescription("The number of times the watch of a given target was started"))
+	record(e)
+
+	r.watchFailures, e = meter.Int64Counter("kuberesolver.watch.failures",
+		metric.WithDescription("The number of times the watch of a given target failed, by reason"))
+	record(e)
+
+	r.watchEvents, e = meter.Int64Counter("kuberesolver.watch.events",
+		metric.WithDescription("The number of watch events received for a given target, by event type"))
+	record(e)
+
+	r.requests, e = meter.Int64Counter("kuberesolver.api.requests",
+		metric.WithDescription("The number of list and watch requests to the kubernetes api, by response code"))
+	record(e)
+
+	r.requestDuration, e = meter.Float64Histogram("kuberesolver.api.request.duration",
+		metric.WithDescription("The latency of list and watch requests to the kubernetes api"),
+		metric.WithUnit("s"))
+	record(e)
+
+	endpoints, e := meter.Int64ObservableGauge("kuberesolver.endpoints",
+		metric.WithDescription("The number of endpoints for a given target"))
+	record(e)
+
+	addresses, e := meter.Int64ObservableGauge("kuberesolver.addresses",
+		metric.WithDescription("The number of addresses for a given target"))
+	record(e)
+
+	lastUpdate, e := meter.Int64ObservableGauge("kuberesolver.client.last_update",
+		metric.WithDescription("The last time the resolver client was updated"),
+		metric.WithUnit("s"))
+	record(e)
+
+	sinceLastEvent, e := meter.Float64ObservableGauge("kuberesolver.watch.since_last_event",
+		metric.WithDescription("The number of seconds since the last watch event or bookmark of a given target"),
+		metric.WithUnit("s"))
+	record(e)
+
+	_, e = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		for target, s := range r.targets {
+			attrs := metric.WithAttributes(attribute.String("target", target))
+			o.ObserveInt64(endpoints, s.endpoints, attrs)
+			o.ObserveInt64(addresses, s.addresses, attrs)
+
+			if !s.lastUpdate.IsZero() {
+				o.ObserveInt64(lastUpdate, s.lastUpdate.Unix(), attrs)
+			}
+
+			if !s.lastEvent.IsZero() {
+				o.ObserveFloat64(sinceLastEvent, time.Since(s.lastEvent).Seconds(), attrs)
+			}
+		}
+
+		return nil
+	}, endpoints, addresses, lastUpdate, sinceLastEvent)
+	record(e)
+
+	return r, err
+}
+
+// update calls f with the state of target if the target is in use.
+func (r *recorder) update(target string, f func(s *targetState)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.targets[target]; ok {
+		f(s)
+	}
+}
+
+func (r *recorder) TargetOpened(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.targets[target]
+	if !ok {
+		s = &targetState{}
+		r.targets[target] = s
+	}
+
+	s.refs++
+}
+
+func (r *recorder) TargetClosed(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.targets[target]
+	if !ok {
+		return
+	}
+
+	s.refs--
+	if s.refs <= 0 {
+		delete(r.targets, target)
+	}
+}
+
+func (r *recorder) ObserveEndpoints(target string, endpoints, addresses int) {
+	r.update(target, func(s *targetState) {
+		s.endpoints = int64(endpoints)
+		s.addresses = int64(addresses)
+	})
+}
+
+func (r *recorder) ObserveUpdate(target string) {
+	r.update(target, func(s *targetState) {
+		s.lastUpdate = time.Now()
+	})
+}
+
+func (r *recorder) ObserveWatchStart(target string) {
+	r.watchStarts.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.String("target", target)))
+}
+
+func (r *recorder) ObserveWatchFailure(target, reason string) {
+	r.watchFailures.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.String("target", target), attribute.String("reason", reason)))
+}
+
+func (r *recorder) ObserveWatchEvent(target string, eventType kuberesolver.EventType) {
+	r.watchEvents.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.String("target", target), attribute.String("type", string(eventType))))
+
+	r.update(target, func(s *targetState) {
+		s.lastEvent = time.Now()
+	})
+}
+
+func (r *recorder) ObserveRequest(verb string, code int, duration time.Duration) {
+	c := "error"
+	if code != 0 {
+		c = strconv.Itoa(code)
+	}
+
+	r.requests.Add(context.Background(), 1,
+		metric.WithAttributes(attribute.String("verb", verb), attribute.String("code", c)))
+	r.requestDuration.Record(context.Background(), duration.Seconds(),
+		metric.WithAttributes(attribute.String("verb", verb)))
+}
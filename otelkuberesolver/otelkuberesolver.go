@@ -0,0 +1,55 @@
+// Package otelkuberesolver instruments kuberesolver with OpenTelemetry.
+//
+// It emits a span for every list and watch request to the kubernetes api and
+// mirrors the Prometheus metrics of kuberesolver as OpenTelemetry instruments:
+//
+//	resolver.Register(kuberesolver.NewBuilderWithOptions(nil, "kubernetes",
+//		otelkuberesolver.WithTracing(),
+//		otelkuberesolver.WithMetrics(),
+//	))
+package otelkuberesolver
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScopeName is the instrumentation scope name of the tracer and the meter.
+const ScopeName = "github.com/sercand/kuberesolver/v6/otelkuberesolver"
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+}
+
+// Option configures the instrumentation.
+type Option func(*config)
+
+// WithTracerProvider sets the TracerProvider, the global one is used by
+// default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithMeterProvider sets the MeterProvider, the global one is used by
+// default.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = mp
+	}
+}
+
+func newConfig(opts []Option) config {
+	c := config{
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
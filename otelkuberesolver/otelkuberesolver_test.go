@@ -0,0 +1,135 @@
+package otelkuberesolver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sercand/kuberesolver/v6"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+type fakeConn struct {
+	updated chan struct{}
+}
+
+func (fc *fakeConn) UpdateState(resolver.State) error {
+	select {
+	case fc.updated <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (fc *fakeConn) ReportError(error) {}
+
+func (fc *fakeConn) NewAddress([]resolver.Address) {}
+
+func (fc *fakeConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	ready := true
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if !strings.Contains(r.URL.Path, "/watch/") {
+			_ = json.NewEncoder(w).Encode(kuberesolver.EndpointSliceList{
+				Metadata: kuberesolver.ListMetadata{ResourceVersion: "1"},
+				Items: []kuberesolver.EndpointSlice{{
+					Metadata: kuberesolver.Metadata{Name: "svc-a"},
+					Endpoints: []kuberesolver.Endpoint{{
+						Addresses:  []string{"10.0.0.1"},
+						Conditions: kuberesolver.EndpointConditions{Ready: &ready},
+					}},
+					Ports: []kuberesolver.EndpointPort{{Name: "grpc", Port: 8080}},
+				}},
+			})
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+}
+
+func TestInstrumentation(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	bl := kuberesolver.NewBuilderWithOptions(kuberesolver.NewInsecureK8sClient(srv.URL), "kubernetes",
+		kuberesolver.WithRegisterer(prometheus.NewRegistry()),
+		WithTracing(WithTracerProvider(tp)),
+		WithMetrics(WithMeterProvider(mp)),
+	)
+	fc := &fakeConn{updated: make(chan struct{}, 1)}
+
+	u, _ := url.Parse("kubernetes:///svc.ns:8080")
+
+	rs, err := bl.Build(resolver.Target{URL: *u}, fc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-fc.updated
+
+	if assert.NotEmpty(t, spans.Ended()) {
+		span := spans.Ended()[0]
+		assert.Equal(t, "kuberesolver list", span.Name())
+	}
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	assert.Equal(t, int64(1), gaugeValue(t, rm, "kuberesolver.addresses"))
+
+	rs.Close()
+
+	// the gauges of a target are dropped with its last resolver
+	rm = metricdata.ResourceMetrics{}
+	assert.NoError(t, reader.Collect(context.Background(), &rm))
+	assert.Equal(t, int64(-1), gaugeValue(t, rm, "kuberesolver.addresses"))
+}
+
+// gaugeValue returns the value of the named int64 gauge, or -1 if it has no
+// data point.
+func gaugeValue(t *testing.T, rm metricdata.ResourceMetrics, name string) int64 {
+	t.Helper()
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+
+			g, ok := m.Data.(metricdata.Gauge[int64])
+			if ok && len(g.DataPoints) > 0 {
+				return g.DataPoints[0].Value
+			}
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,63 @@
+package otelkuberesolver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sercand/kuberesolver/v6"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracing returns a builder option that starts a client span for every
+// list and watch request of the resolvers. The span of a watch ends when the
+// apiserver responded, not when the watch ends.
+func WithTracing(opts ...Option) kuberesolver.Option {
+	c := newConfig(opts)
+	tracer := c.tracerProvider.Tracer(ScopeName)
+
+	return kuberesolver.WithClientWrapper(func(client kuberesolver.K8sClient) kuberesolver.K8sClient {
+		return &tracingClient{K8sClient: client, tracer: tracer}
+	})
+}
+
+type tracingClient struct {
+	kuberesolver.K8sClient
+	tracer trace.Tracer
+}
+
+func (c *tracingClient) Do(req *http.Request) (*http.Response, error) {
+	ctx, span := c.tracer.Start(req.Context(), "kuberesolver "+verb(req),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	resp, err := c.K8sClient.Do(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		return resp, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func verb(req *http.Request) string {
+	if strings.Contains(req.URL.Path, "/watch/") || req.URL.Query().Get("watch") == "true" {
+		return "watch"
+	}
+
+	return "list"
+}
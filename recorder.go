@@ -0,0 +1,81 @@
+package kuberesolver
+
+import "time"
+
+// MetricsRecorder receives the measurements of the resolvers of a builder,
+// in addition to the Prometheus metrics. It can be used to export them to
+// another metrics system. Implementations must be safe for concurrent use.
+type MetricsRecorder interface {
+	// TargetOpened is called when a resolver for target is built.
+	TargetOpened(target string)
+	// TargetClosed is called when a resolver for target is closed. Once it
+	// was called as often as TargetOpened, the target is no longer in use.
+	TargetClosed(target string)
+	// ObserveEndpoints is called after every change of the EndpointSlices of
+	// target with the number of endpoints and the number of addresses.
+	ObserveEndpoints(target string, endpoints, addresses int)
+	// ObserveUpdate is called when a new address list is handed to gRPC.
+	ObserveUpdate(target string)
+	// ObserveWatchStart is called when the watch of target is (re)started.
+	ObserveWatchStart(target string)
+	// ObserveWatchFailure is called when the list or watch of target failed,
+	// reason is a snake_case label such as forbidden or stalled.
+	ObserveWatchFailure(target, reason string)
+	// ObserveWatchEvent is called for every event received for target.
+	ObserveWatchEvent(target string, eventType EventType)
+	// ObserveRequest is called after a list or watch request to the kubernetes
+	// api got a response. A zero code means that the request failed without
+	// response.
+	ObserveRequest(verb string, code int, duration time.Duration)
+}
+
+// multiRecorder passes the measurements to all of its recorders.
+type multiRecorder []MetricsRecorder
+
+func (m multiRecorder) TargetOpened(target string) {
+	for _, r := range m {
+		r.TargetOpened(target)
+	}
+}
+
+func (m multiRecorder) TargetClosed(target string) {
+	for _, r := range m {
+		r.TargetClosed(target)
+	}
+}
+
+func (m multiRecorder) ObserveEndpoints(target string, endpoints, addresses int) {
+	for _, r := range m {
+		r.ObserveEndpoints(target, endpoints, addresses)
+	}
+}
+
+func (m multiRecorder) ObserveUpdate(target string) {
+	for _, r := range m {
+		r.ObserveUpdate(target)
+	}
+}
+
+func (m multiRecorder) ObserveWatchStart(target string) {
+	for _, r := range m {
+		r.ObserveWatchStart(target)
+	}
+}
+
+func (m multiRecorder) ObserveWatchFailure(target, reason string) {
+	for _, r := range m {
+		r.ObserveWatchFailure(target, reason)
+	}
+}
+
+func (m multiRecorder) ObserveWatchEvent(target string, eventType EventType) {
+	for _, r := range m {
+		r.ObserveWatchEvent(target, eventType)
+	}
+}
+
+func (m multiRecorder) ObserveRequest(verb string, code int, duration time.Duration) {
+	for _, r := range m {
+		r.ObserveRequest(verb, code, duration)
+	}
+}
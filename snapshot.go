@@ -0,0 +1,153 @@
+package kuberesolver
+
+import (
+	"sort"
+	"time"
+)
+
+// ResolverSnapshot is the state of a resolver at the time Snapshot was called.
+type ResolverSnapshot struct {
+	// Target is the parsed target, e.g. kubernetes://namespace/service:port.
+	Target    string `json:"target"`
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Port      string `json:"port"`
+	// ResolveByPortName reports whether Port is the name of a service port.
+	ResolveByPortName bool `json:"resolveByPortName"`
+	// UseFirstPort reports whether the target has no port and the first port
+	// of the EndpointSlices is used.
+	UseFirstPort bool `json:"useFirstPort"`
+	// Addresses are the addresses last handed to gRPC.
+	Addresses []string `json:"addresses"`
+	// LastUpdate is the time Addresses were handed to gRPC.
+	LastUpdate time.Time `json:"lastUpdate"`
+	// Slices are the known EndpointSlices of the service, sorted by name.
+	Slices []SliceSnapshot `json:"slices"`
+	// ResourceVersion is the version the watch resumes from. It is empty if
+	// the EndpointSlices have to be listed again.
+	ResourceVersion string `json:"resourceVersion"`
+	// LastError is the error of the last failed list or watch, if any.
+	LastError     string        `json:"lastError,omitempty"`
+	LastErrorTime time.Time     `json:"lastErrorTime"`
+	Watch         WatchSnapshot `json:"watch"`
+	// History holds the most recent address updates, oldest first.
+	History []UpdateRecord `json:"history"`
+}
+
+// UpdateRecord describes an address list handed to gRPC.
+type UpdateRecord struct {
+	Time            time.Time `json:"time"`
+	ResourceVersion string    `json:"resourceVersion"`
+	Addresses       []string  `json:"addresses"`
+}
+
+// SliceSnapshot is the contribution of an EndpointSlice to the addresses of a
+// resolver.
+type SliceSnapshot struct {
+	Name            string     `json:"name"`
+	ResourceVersion string     `json:"resourceVersion"`
+	Endpoints       []Endpoint `json:"endpoints"`
+	// Addresses are the addresses of the ready endpoints accepted by the
+	// endpoint filters.
+	Addresses []string `json:"addresses"`
+}
+
+// WatchSnapshot describes the health of the watch of a resolver.
+type WatchSnapshot struct {
+	// Active reports whether the watch is currently established.
+	Active bool `json:"active"`
+	// Started is the time the current or last watch was established.
+	Started time.Time `json:"started"`
+	// Starts is the number of times a watch was established.
+	Starts int `json:"starts"`
+	// LastEvent is the time the last event or bookmark was received.
+	LastEvent time.Time `json:"lastEvent"`
+}
+
+// Snapshot returns the state of every active resolver of the builder, sorted
+// by target. There can be several resolvers for the same target, one for
+// every gRPC ClientConn.
+func (b *Builder) Snapshot() []ResolverSnapshot {
+	b.mu.Lock()
+	resolvers := make([]*kResolver, 0, len(b.resolvers))
+
+	for r := range b.resolvers {
+		resolvers = append(resolvers, r)
+	}
+	b.mu.Unlock()
+
+	snapshots := make([]ResolverSnapshot, 0, len(resolvers))
+	for _, r := range resolvers {
+		snapshots = append(snapshots, r.snapshot())
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Target < snapshots[j].Target
+	})
+
+	return snapshots
+}
+
+func (k *kResolver) snapshot() ResolverSnapshot {
+	// the watch state is owned by the informer, the locks are never held
+	// together since the informer calls into the resolver with inf.mu released
+	inf := k.informer
+	inf.mu.Lock()
+	s := ResolverSnapshot{
+		Target:            k.target.String(),
+		Namespace:         k.target.serviceNamespace,
+		Service:           k.target.serviceName,
+		Port:              k.target.port,
+		ResolveByPortName: k.target.resolveByPortName,
+		UseFirstPort:      k.target.useFirstPort,
+		Slices:            make([]SliceSnapshot, 0, len(inf.slices[k.target.serviceName])),
+		ResourceVersion:   inf.resourceVersion,
+		LastErrorTime:     inf.lastErrTime,
+		Watch: WatchSnapshot{
+			Active:    inf.watching,
+			Started:   inf.watchStarted,
+			Starts:    inf.watchStarts,
+			LastEvent: inf.lastEvent,
+		},
+	}
+
+	if inf.lastErr != nil {
+		s.LastError = inf.lastErr.Error()
+	}
+
+	slices := inf.slices[k.target.serviceName]
+	inf.mu.Unlock()
+
+	k.mu.Lock()
+	s.Addresses = make([]string, 0, len(k.published))
+	for _, a := range k.published {
+		s.Addresses = append(s.Addresses, a.Addr)
+	}
+
+	s.LastUpdate = k.lastUpdate
+	s.History = append([]UpdateRecord(nil), k.history...)
+	k.mu.Unlock()
+
+	// the published slices map is never modified and can be read unlocked
+	for _, e := range slices {
+		addrs, _ := k.makeAddresses(e)
+
+		slice := SliceSnapshot{
+			Name:            e.Metadata.Name,
+			ResourceVersion: e.Metadata.ResourceVersion,
+			Endpoints:       e.Endpoints,
+			Addresses:       make([]string, 0, len(addrs)),
+		}
+		for _, a := range addrs {
+			slice.Addresses = append(slice.Addresses, a.Addr)
+		}
+
+		s.Slices = append(s.Slices, slice)
+	}
+
+	sort.Slice(s.Slices, func(i, j int) bool {
+		return s.Slices[i].Name < s.Slices[j].Name
+	})
+
+	return s
+}
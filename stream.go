@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"io"
 	"sync"
-
-	"google.golang.org/grpc/grpclog"
 )
 
 // Interface can be implemented by anything that knows how to watch and report changes.
@@ -20,16 +18,22 @@ type watchInterface interface {
 	// or Stop() is called, this channel will be closed, in which case the
 	// watch should be completely cleaned up.
 	ResultChan() <-chan Event
+
+	// Err returns the error that ended the watch once the channel returned by
+	// ResultChan() is closed. It is nil if the watch ended normally.
+	Err() error
 }
 
 // StreamWatcher turns any stream for which you can write a Decoder interface
 // into a watch.Interface.
 type streamWatcher struct {
 	result  chan Event
+	done    chan struct{}
 	r       io.ReadCloser
 	decoder *json.Decoder
 	sync.Mutex
 	stopped bool
+	err     error
 }
 
 // NewStreamWatcher creates a StreamWatcher from the given io.ReadClosers.
@@ -38,6 +42,7 @@ func newStreamWatcher(r io.ReadCloser) watchInterface {
 		r:       r,
 		decoder: json.NewDecoder(r),
 		result:  make(chan Event),
+		done:    make(chan struct{}),
 	}
 	go sw.receive()
 
@@ -56,10 +61,19 @@ func (sw *streamWatcher) Stop() {
 
 	if !sw.stopped {
 		sw.stopped = true
+		close(sw.done)
 		_ = sw.r.Close()
 	}
 }
 
+// Err implements Interface.
+func (sw *streamWatcher) Err() error {
+	sw.Lock()
+	defer sw.Unlock()
+
+	return sw.err
+}
+
 // stopping returns true if Stop() was called previously.
 func (sw *streamWatcher) stopping() bool {
 	sw.Lock()
@@ -68,6 +82,13 @@ func (sw *streamWatcher) stopping() bool {
 	return sw.stopped
 }
 
+func (sw *streamWatcher) setErr(err error) {
+	sw.Lock()
+	defer sw.Unlock()
+
+	sw.err = err
+}
+
 // receive reads result from the decoder in a loop and sends down the result channel.
 func (sw *streamWatcher) receive() {
 	defer close(sw.result)
@@ -87,30 +108,49 @@ func (sw *streamWatcher) receive() {
 			case context.Canceled:
 				// canceled normally
 			case io.ErrUnexpectedEOF:
-				grpclog.Infof("kuberesolver: Unexpected EOF during watch stream event decoding: %v", err)
+				sw.setErr(fmt.Errorf("unexpected EOF during watch stream event decoding: %w", err))
 			default:
-				grpclog.Infof("kuberesolver: Unable to decode an event from the watch stream: %v", err)
+				sw.setErr(fmt.Errorf("unable to decode an event from the watch stream: %w", err))
 			}
 
 			return
 		}
 
-		sw.result <- obj
+		// a stopped watch may no longer be read, do not block on the send
+		select {
+		case sw.result <- obj:
+		case <-sw.done:
+			return
+		}
 	}
 }
 
 // Decode blocks until it can return the next object in the writer. Returns an error
 // if the writer is closed or an object can't be decoded.
 func (sw *streamWatcher) Decode() (Event, error) {
-	var got Event
+	var got struct {
+		Type   EventType       `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
 	if err := sw.decoder.Decode(&got); err != nil {
 		return Event{}, err
 	}
 
+	e := Event{Type: got.Type, Raw: got.Object}
+
 	switch got.Type {
-	case Added, Modified, Deleted, Error:
-		return got, nil
+	case Added, Modified, Deleted, Bookmark:
+		if err := json.Unmarshal(got.Object, &e.Object); err != nil {
+			return Event{}, fmt.Errorf("unable to decode %s event object: %w", got.Type, err)
+		}
+	case Error:
+		e.Status = &Status{}
+		if err := json.Unmarshal(got.Object, e.Status); err != nil {
+			return Event{}, fmt.Errorf("unable to decode %s event object: %w", got.Type, err)
+		}
 	default:
 		return Event{}, fmt.Errorf("got invalid watch event type: %v", got.Type)
 	}
+
+	return e, nil
 }
@@ -0,0 +1,63 @@
+package kuberesolver
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamWatcherDecode(t *testing.T) {
+	stream := `{"type":"ADDED","object":{"metadata":{"name":"svc-a","resourceVersion":"10"},"endpoints":[{"addresses":["10.0.0.1"]}]}}
+{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"11"}}}
+{"type":"ERROR","object":{"kind":"Status","status":"Failure","message":"too old resource version: 1 (11)","reason":"Expired","code":410}}
+`
+	sw := &streamWatcher{
+		decoder: json.NewDecoder(strings.NewReader(stream)),
+	}
+
+	e, err := sw.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, Added, e.Type)
+	assert.Equal(t, "svc-a", e.Object.Metadata.Name)
+	assert.Equal(t, []string{"10.0.0.1"}, e.Object.Endpoints[0].Addresses)
+
+	e, err = sw.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, Bookmark, e.Type)
+	assert.Equal(t, "11", e.Object.Metadata.ResourceVersion)
+
+	e, err = sw.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, Error, e.Type)
+
+	if assert.NotNil(t, e.Status) {
+		assert.Equal(t, 410, e.Status.Code)
+		assert.Equal(t, StatusReasonExpired, e.Status.Reason)
+		assert.True(t, IsGone(&StatusError{Status: *e.Status}))
+	}
+
+	_, err = sw.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestStreamWatcherStop(t *testing.T) {
+	stream := `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"11"}}}
+`
+	sw := newStreamWatcher(io.NopCloser(strings.NewReader(stream)))
+
+	// the event is never read, stopping must not leave the receiving
+	// goroutine blocked on it
+	sw.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case _, ok := <-sw.ResultChan():
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("result channel was not closed")
+	}
+}
@@ -0,0 +1,272 @@
+package kuberesolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TokenSource provides the bearer token sent with every request to the
+// apiserver. Token is called for each request and must be safe for
+// concurrent use; an empty token sends no Authorization header.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+type staticTokenSource string
+
+// NewStaticTokenSource returns a TokenSource always returning token.
+func NewStaticTokenSource(token string) TokenSource {
+	return staticTokenSource(token)
+}
+
+func (s staticTokenSource) Token() (string, error) {
+	return string(s), nil
+}
+
+// fileTokenSource reads the token from a file, such as a projected service
+// account token, and reads it again whenever the file changes or the token
+// expires.
+type fileTokenSource struct {
+	path    string
+	watcher *fsnotify.Watcher
+
+	mu     sync.RWMutex
+	token  string
+	expiry time.Time
+}
+
+// NewFileTokenSource returns a TokenSource reading the token from path. The
+// file is read again when it changes and when the token, if it is a JWT,
+// reaches its exp claim. The returned TokenSource implements io.Closer to
+// stop watching the file.
+func NewFileTokenSource(path string) (TokenSource, error) {
+	s := &fileTokenSource{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := watchFiles(func() { _ = s.reload() }, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.watcher = watcher
+
+	return s, nil
+}
+
+// Close stops watching the file.
+func (s *fileTokenSource) Close() error {
+	return s.watcher.Close()
+}
+
+func (s *fileTokenSource) Token() (string, error) {
+	s.mu.RLock()
+	token, expiry := s.token, s.expiry
+	s.mu.RUnlock()
+
+	if !expiry.IsZero() && time.Now().After(expiry) {
+		// the change of the file may have been missed
+		if err := s.reload(); err != nil {
+			return "", err
+		}
+
+		s.mu.RLock()
+		token = s.token
+		s.mu.RUnlock()
+	}
+
+	return token, nil
+}
+
+func (s *fileTokenSource) reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		// the file is being rewritten, it is read again on the next event
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = token
+	s.expiry = jwtExpiry(token)
+
+	return nil
+}
+
+// jwtExpiry returns the exp claim of a JWT, or the zero time if token is not
+// a JWT or has no exp claim. The signature is not verified.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
+
+// tokenRequest is the TokenRequest object of the authentication.k8s.io API.
+type tokenRequest struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Spec       tokenRequestSpec   `json:"spec"`
+	Status     tokenRequestStatus `json:"status"`
+}
+
+type tokenRequestSpec struct {
+	Audiences         []string `json:"audiences"`
+	ExpirationSeconds *int64   `json:"expirationSeconds,omitempty"`
+}
+
+type tokenRequestStatus struct {
+	Token               string    `json:"token"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+// tokenRequestSource requests tokens of a service account with the
+// TokenRequest API.
+type tokenRequestSource struct {
+	client         K8sClient
+	namespace      string
+	serviceAccount string
+	audiences      []string
+	expiration     time.Duration
+
+	mu        sync.Mutex
+	token     string
+	expiry    time.Time
+	refreshAt time.Time
+}
+
+// NewTokenRequestTokenSource returns a TokenSource requesting tokens of the
+// given service account for the given audiences with the TokenRequest API,
+// using client to talk to the apiserver. A zero expiration uses the default
+// of the apiserver. Tokens are renewed once 80% of their lifetime passed,
+// like the kubelet does for projected tokens.
+func NewTokenRequestTokenSource(client K8sClient, namespace, serviceAccount string, audiences []string, expiration time.Duration) TokenSource {
+	return &tokenRequestSource{
+		client:         client,
+		namespace:      namespace,
+		serviceAccount: serviceAccount,
+		audiences:      audiences,
+		expiration:     expiration,
+	}
+}
+
+func (s *tokenRequestSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.token != "" && now.Before(s.refreshAt) {
+		return s.token, nil
+	}
+
+	status, err := s.request()
+	if err != nil {
+		if s.token != "" && now.Before(s.expiry) {
+			// the current token is still valid, retry on the next request
+			return s.token, nil
+		}
+
+		return "", err
+	}
+
+	s.token = status.Token
+	s.expiry = status.ExpirationTimestamp
+	s.refreshAt = now.Add(s.expiry.Sub(now) * 8 / 10)
+
+	return s.token, nil
+}
+
+func (s *tokenRequestSource) request() (tokenRequestStatus, error) {
+	body := tokenRequest{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenRequest",
+		Spec:       tokenRequestSpec{Audiences: s.audiences},
+	}
+
+	if s.expiration > 0 {
+		seconds := int64(s.expiration / time.Second)
+		body.Spec.ExpirationSeconds = &seconds
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return tokenRequestStatus{}, err
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/serviceaccounts/%s/token",
+		s.client.Host(), url.PathEscape(s.namespace), url.PathEscape(s.serviceAccount))
+
+	req, err := s.client.GetRequest(u)
+	if err != nil {
+		return tokenRequestStatus{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// K8sClient only builds GET requests, turn it into the create call
+	req = req.WithContext(ctx)
+	req.Method = http.MethodPost
+	req.Header.Set("Content-Type", "application/json")
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return tokenRequestStatus{}, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return tokenRequestStatus{}, fmt.Errorf("invalid response code %d for token request of service account %s in namespace %s", resp.StatusCode, s.serviceAccount, s.namespace)
+	}
+
+	var result tokenRequest
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return tokenRequestStatus{}, err
+	}
+
+	if result.Status.Token == "" {
+		return tokenRequestStatus{}, fmt.Errorf("token request of service account %s in namespace %s returned no token", s.serviceAccount, s.namespace)
+	}
+
+	return result.Status, nil
+}
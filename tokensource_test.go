@@ -0,0 +1,107 @@
+package kuberesolver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJWT(exp time.Time) string {
+	enc := base64.RawURLEncoding
+
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(fmt.Sprintf(`{"sub":"test","exp":%d}`, exp.Unix()))) + ".sig"
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	assert.Equal(t, exp, jwtExpiry(newTestJWT(exp)))
+	assert.True(t, jwtExpiry("opaque-token").IsZero())
+	assert.True(t, jwtExpiry("a.!!.c").IsZero())
+}
+
+func TestFileTokenSource(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "token", "first\n")
+
+	ts, err := NewFileTokenSource(path)
+	require.NoError(t, err)
+
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "first", token)
+
+	writeFile(t, dir, "token", "second")
+	assert.Eventually(t, func() bool {
+		token, _ := ts.Token()
+		return token == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an expired token is read again even if the change was not seen
+	fresh := newTestJWT(time.Now().Add(time.Hour))
+	s := ts.(*fileTokenSource)
+	s.mu.Lock()
+	s.expiry = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	writeFile(t, dir, "token", fresh)
+
+	token, err = ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, fresh, token)
+}
+
+func TestTokenRequestTokenSource(t *testing.T) {
+	var requests atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/api/v1/namespaces/ns/serviceaccounts/resolver/token", r.URL.Path)
+		assert.Equal(t, "Bearer bootstrap", r.Header.Get("Authorization"))
+
+		var req tokenRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, []string{"kuberesolver"}, req.Spec.Audiences)
+		assert.Equal(t, int64(3600), *req.Spec.ExpirationSeconds)
+
+		n := requests.Add(1)
+		req.Status = tokenRequestStatus{
+			Token:               fmt.Sprintf("token-%d", n),
+			ExpirationTimestamp: time.Now().Add(time.Hour),
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(req)
+	}))
+	defer srv.Close()
+
+	bootstrap, err := NewK8sClientWithTokenSource(srv.URL, "", NewStaticTokenSource("bootstrap"))
+	require.NoError(t, err)
+
+	ts := NewTokenRequestTokenSource(bootstrap, "ns", "resolver", []string{"kuberesolver"}, time.Hour)
+
+	for range 3 {
+		token, err := ts.Token()
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", token)
+	}
+
+	assert.Equal(t, int32(1), requests.Load())
+
+	// the token is renewed once 80% of its lifetime passed
+	s := ts.(*tokenRequestSource)
+	s.mu.Lock()
+	s.refreshAt = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+
+	token, err := ts.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+}
@@ -0,0 +1,140 @@
+package kuberesolver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultDialTimeout          = time.Second * 30
+	defaultKeepAlive            = time.Second * 30
+	defaultTLSHandshakeTimeout  = time.Second * 10
+	defaultIdleConnTimeout      = time.Second * 90
+	defaultHTTP2ReadIdleTimeout = time.Second * 30
+	defaultHTTP2PingTimeout     = time.Second * 15
+)
+
+// ClientOptions configures the connections of a K8sClient to the apiserver.
+// The zero value uses the defaults documented on each field.
+type ClientOptions struct {
+	// MinTLSVersion is the minimum TLS version accepted from the apiserver.
+	// Default is tls.VersionTLS12.
+	MinTLSVersion uint16
+	// RootCAs are PEM encoded certificates trusted in addition to the
+	// certificate authority of the cluster.
+	RootCAs []byte
+	// ServerName overrides the name sent with SNI and used to verify the
+	// certificate of the apiserver.
+	ServerName string
+	// Proxy returns the proxy of a request. Default is
+	// http.ProxyFromEnvironment, which honors HTTPS_PROXY and NO_PROXY.
+	Proxy func(*http.Request) (*url.URL, error)
+	// DialTimeout bounds the time to open a connection. Default is 30
+	// seconds.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the time of the TLS handshake. Default is
+	// 10 seconds.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the time to wait for the response headers
+	// after sending a request; watches answer with the headers right away.
+	// Default is no timeout.
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is the time after which an idle connection is closed.
+	// Default is 90 seconds.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the interval of the TCP keepalive probes, negative to
+	// disable them. Default is 30 seconds.
+	KeepAlive time.Duration
+	// HTTP2ReadIdleTimeout is the time without any frame received after
+	// which an HTTP/2 ping checks the health of a connection, negative to
+	// disable the health checks. Default is 30 seconds.
+	HTTP2ReadIdleTimeout time.Duration
+	// HTTP2PingTimeout is the time after which a connection is closed if a
+	// ping is not answered. Default is 15 seconds.
+	HTTP2PingTimeout time.Duration
+}
+
+// tlsConfig applies the TLS options to config.
+func (o ClientOptions) tlsConfig(config *tls.Config) error {
+	if o.MinTLSVersion != 0 {
+		config.MinVersion = o.MinTLSVersion
+	}
+
+	if o.ServerName != "" {
+		config.ServerName = o.ServerName
+	}
+
+	if len(o.RootCAs) > 0 {
+		if config.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				return err
+			}
+
+			config.RootCAs = pool
+		}
+
+		if !config.RootCAs.AppendCertsFromPEM(o.RootCAs) {
+			return fmt.Errorf("no certificate found in RootCAs")
+		}
+	}
+
+	return nil
+}
+
+// transport returns the transport connecting to the apiserver with config.
+func (o ClientOptions) transport(config *tls.Config) (*http.Transport, error) {
+	if err := o.tlsConfig(config); err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   withDefault(o.DialTimeout, defaultDialTimeout),
+		KeepAlive: withDefault(o.KeepAlive, defaultKeepAlive),
+	}
+
+	proxy := o.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       config,
+		TLSHandshakeTimeout:   withDefault(o.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		IdleConnTimeout:       withDefault(o.IdleConnTimeout, defaultIdleConnTimeout),
+		// a custom TLS configuration disables HTTP/2 unless forced
+		ForceAttemptHTTP2: true,
+	}
+
+	if readIdle := withDefault(o.HTTP2ReadIdleTimeout, defaultHTTP2ReadIdleTimeout); readIdle > 0 {
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, err
+		}
+
+		h2.ReadIdleTimeout = readIdle
+		h2.PingTimeout = withDefault(o.HTTP2PingTimeout, defaultHTTP2PingTimeout)
+	}
+
+	return transport, nil
+}
+
+// withDefault returns def if d is zero. Negative durations are kept, they
+// disable the setting.
+func withDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+
+	return d
+}
@@ -0,0 +1,107 @@
+package kuberesolver
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientOptionsDefaults(t *testing.T) {
+	transport, err := ClientOptions{}.transport(&tls.Config{MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+
+	assert.Equal(t, uint16(tls.VersionTLS12), transport.TLSClientConfig.MinVersion)
+	assert.Equal(t, defaultTLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+	assert.Zero(t, transport.ResponseHeaderTimeout)
+	assert.NotNil(t, transport.Proxy)
+	assert.True(t, transport.ForceAttemptHTTP2)
+
+	transport, err = ClientOptions{
+		MinTLSVersion:         tls.VersionTLS13,
+		ServerName:            "kubernetes.default.svc",
+		ResponseHeaderTimeout: time.Minute,
+	}.transport(&tls.Config{})
+	require.NoError(t, err)
+
+	assert.Equal(t, uint16(tls.VersionTLS13), transport.TLSClientConfig.MinVersion)
+	assert.Equal(t, "kubernetes.default.svc", transport.TLSClientConfig.ServerName)
+	assert.Equal(t, time.Minute, transport.ResponseHeaderTimeout)
+
+	_, err = ClientOptions{RootCAs: []byte("not a certificate")}.transport(&tls.Config{})
+	assert.Error(t, err)
+}
+
+func TestClientOptionsTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Server-Name", r.TLS.ServerName)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the test certificate is valid for example.com
+	client, err := NewInsecureK8sClientWithOptions(srv.URL, ClientOptions{
+		RootCAs:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+		ServerName: "example.com",
+	})
+	require.NoError(t, err)
+
+	resp := doTestRequest(t, client)
+	assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+	assert.Equal(t, "example.com", resp.Header.Get("X-Server-Name"))
+}
+
+func TestClientOptionsProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	client, err := NewInsecureK8sClientWithOptions("http://kubernetes.invalid", ClientOptions{
+		Proxy: http.ProxyURL(proxyURL),
+	})
+	require.NoError(t, err)
+
+	doTestRequest(t, client)
+	assert.Equal(t, "http://kubernetes.invalid/api", <-proxied)
+}
+
+func TestClientOptionsWithCredentials(t *testing.T) {
+	srv := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	cert, key := newTestCert(t, "alice")
+	certFile := writeFile(t, dir, "client.crt", string(cert))
+	keyFile := writeFile(t, dir, "client.key", string(key))
+
+	// the CA and server name of the test server are only given as options
+	opts := ClientOptions{
+		RootCAs:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}),
+		ServerName: "example.com",
+	}
+
+	client, err := NewK8sClientWithClientCertWithOptions(srv.URL, "", certFile, keyFile, opts)
+	require.NoError(t, err)
+	defer client.(io.Closer).Close()
+
+	assert.Equal(t, "alice", doTestRequest(t, client).Header.Get("X-Client-Cn"))
+
+	client, err = NewK8sClientWithTokenSourceWithOptions(srv.URL, "", NewStaticTokenSource("secret"), opts)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Bearer secret", doTestRequest(t, client).Header.Get("X-Authorization"))
+}
@@ -1,45 +1,78 @@
 package kuberesolver
 
 import (
+	"fmt"
+	"log/slog"
+	"math/rand"
 	"runtime/debug"
 	"time"
-
-	"google.golang.org/grpc/grpclog"
 )
 
-func until(f func(), initialPeriod, maxPeriod time.Duration, stopCh <-chan struct{}) {
+// backoff defines the delays between the runs of until: the period doubles
+// after each run up to max, and is reset to initial after a run lasting at
+// least healthy.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	// jitter is the randomized fraction of each delay, 1 waits a random
+	// duration between zero and the period (full jitter).
+	jitter float64
+	// healthy is the duration of a run after which the period is reset.
+	healthy time.Duration
+}
+
+// wait returns the delay before the next run for the current period.
+func (b backoff) wait(period time.Duration) time.Duration {
+	jitter := min(max(b.jitter, 0), 1)
+
+	return period - time.Duration(rand.Float64()*jitter*float64(period))
+}
+
+// next returns the period following period.
+func (b backoff) next(period time.Duration) time.Duration {
+	return min(period*2, b.max)
+}
+
+// until runs f until stopCh is closed, waiting between the runs according to
+// b. f returns how long it was healthy, e.g. for how long its watch was
+// established, the period is reset once that reaches b.healthy.
+func until(f func() time.Duration, b backoff, stopCh <-chan struct{}, logger *slog.Logger) {
 	select {
 	case <-stopCh:
 		return
 	default:
 	}
 
-	period := initialPeriod
+	period := b.initial
 
 	for {
+		var healthy time.Duration
+
 		func() {
-			defer handleCrash()
+			defer handleCrash(logger)
 
-			f()
+			healthy = f()
 		}()
 
+		// a run that was healthy long enough, e.g. a watch ended by the
+		// apiserver, does not keep backing off from earlier failures
+		if healthy >= b.healthy {
+			period = b.initial
+		}
+
 		select {
 		case <-stopCh:
 			return
-		case <-time.After(period):
-			if period*2 <= maxPeriod {
-				period *= 2
-			} else {
-				period = initialPeriod
-			}
+		case <-time.After(b.wait(period)):
+			period = b.next(period)
 		}
 	}
 }
 
 // HandleCrash simply catches a crash and logs an error. Meant to be called via defer.
-func handleCrash() {
+func handleCrash(logger *slog.Logger) {
 	if r := recover(); r != nil {
 		callers := string(debug.Stack())
-		grpclog.Errorf("kuberesolver: recovered from panic: %#v (%v)\n%v", r, r, callers)
+		logger.Error("recovered from panic", "panic", fmt.Sprintf("%#v (%v)", r, r), "stack", callers)
 	}
 }